@@ -0,0 +1,344 @@
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sources of client identities; Identities are qualified by their source (i.e. token:mediawiki, or
+// cert:mw1001.eqiad.wmnet), so that those of one means of authentication cannot be assumed by way of another (i.e.
+// with a token named for a certificate CN).
+const (
+	sourceToken = "token"
+	sourceHMAC  = "hmac"
+	sourceCert  = "cert"
+)
+
+var identitySources = []string{sourceToken, sourceHMAC, sourceCert}
+
+// qualifyIdentity returns an identity qualified by its source.
+func qualifyIdentity(source, identity string) string {
+	return source + ":" + identity
+}
+
+// Authenticator validates bearer tokens, returning the identity of the client a token was issued to.
+type Authenticator interface {
+	Authenticate(token string) (string, bool)
+	// Source returns the source of the identities authenticated (one of identitySources).
+	Source() string
+}
+
+// TokenAuthenticator authenticates static bearer tokens.
+type TokenAuthenticator struct {
+	filename string
+
+	mu sync.RWMutex
+	// Map of token to (token) name
+	tokens map[string]string
+}
+
+// NewTokenAuthenticator returns a TokenAuthenticator for the tokens in a file.  The file contains one token per
+// line, in the form `<name> <token>`; Blank lines, and lines beginning with `#` are ignored.
+func NewTokenAuthenticator(filename string) (*TokenAuthenticator, error) {
+	tokens, err := readTokens(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenAuthenticator{filename: filename, tokens: tokens}, nil
+}
+
+// Reload re-reads the tokens file; On error, the tokens previously read remain in use.
+func (a *TokenAuthenticator) Reload() error {
+	tokens, err := readTokens(a.filename)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.tokens = tokens
+	a.mu.Unlock()
+
+	return nil
+}
+
+// readTokens returns a map of token to (token) name, of the tokens in a file.
+func readTokens(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	tokens := make(map[string]string)
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s, line %d: expected `<name> <token>`", filename, lineno)
+		}
+
+		name, token := fields[0], fields[1]
+		if names[name] {
+			return nil, fmt.Errorf("%s, line %d: duplicate token name (%s)", filename, lineno, name)
+		}
+		if _, ok := tokens[token]; ok {
+			return nil, fmt.Errorf("%s, line %d: duplicate token", filename, lineno)
+		}
+
+		names[name] = true
+		tokens[token] = name
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// Authenticate returns the name of a token, if valid.
+func (a *TokenAuthenticator) Authenticate(token string) (string, bool) {
+	var identity string
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	// Compare against every token (in constant time), so that timing reveals nothing about which
+	// (if any) were a near match.
+	for candidate, name := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			identity = name
+		}
+	}
+
+	return identity, identity != ""
+}
+
+// Source returns the source of TokenAuthenticator identities.
+func (a *TokenAuthenticator) Source() string {
+	return sourceToken
+}
+
+// HMACAuthenticator authenticates tokens signed with a shared secret.  Tokens are of the form
+// `<identity>:<expiry>:<signature>`, where expiry is a Unix timestamp, and signature is the (unpadded,
+// URL-safe) base64 encoding of the HMAC-SHA256 of `<identity>:<expiry>`.
+type HMACAuthenticator struct {
+	filename string
+	now      func() time.Time
+
+	mu     sync.RWMutex
+	secret []byte
+}
+
+// NewHMACAuthenticator returns an HMACAuthenticator for the shared secret.
+func NewHMACAuthenticator(secret string) *HMACAuthenticator {
+	return &HMACAuthenticator{secret: []byte(secret), now: time.Now}
+}
+
+// ReadHMACAuthenticator returns an HMACAuthenticator for the shared secret contained in a file.
+func ReadHMACAuthenticator(filename string) (*HMACAuthenticator, error) {
+	a := &HMACAuthenticator{filename: filename, now: time.Now}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload re-reads the secret file (if any); On error, the secret previously read remains in use.
+func (a *HMACAuthenticator) Reload() error {
+	if a.filename == "" {
+		return nil
+	}
+
+	secret, err := readSecretFile(a.filename)
+	if err != nil {
+		return err
+	}
+	if len(secret) < minHMACSecretLength {
+		return fmt.Errorf("HMAC secret in %s must be at least %d characters", a.filename, minHMACSecretLength)
+	}
+
+	a.mu.Lock()
+	a.secret = []byte(secret)
+	a.mu.Unlock()
+
+	return nil
+}
+
+// Authenticate returns the identity of a token, if properly signed and unexpired.
+func (a *HMACAuthenticator) Authenticate(token string) (string, bool) {
+	i := strings.LastIndex(token, ":")
+	if i < 0 {
+		return "", false
+	}
+
+	payload, signature := token[:i], token[i+1:]
+
+	j := strings.LastIndex(payload, ":")
+	if j < 1 {
+		return "", false
+	}
+
+	identity, expiry := payload[:j], payload[j+1:]
+
+	a.mu.RLock()
+	expected := sign(a.secret, payload)
+	a.mu.RUnlock()
+
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return "", false
+	}
+
+	expires, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || a.now().Unix() >= expires {
+		return "", false
+	}
+
+	return identity, true
+}
+
+// Source returns the source of HMACAuthenticator identities.
+func (a *HMACAuthenticator) Source() string {
+	return sourceHMAC
+}
+
+// SignToken returns an HMAC-signed token for identity, that expires at the time specified.
+func SignToken(secret string, identity string, expires time.Time) string {
+	payload := fmt.Sprintf("%s:%d", identity, expires.Unix())
+	return fmt.Sprintf("%s:%s", payload, sign([]byte(secret), payload))
+}
+
+func sign(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewAuthenticators returns the Authenticators enabled in config (if any).
+func NewAuthenticators(config *Config) ([]Authenticator, error) {
+	var authenticators []Authenticator
+
+	if config.Authentication.TokensFile != "" {
+		auth, err := NewTokenAuthenticator(config.Authentication.TokensFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, auth)
+	}
+
+	if config.Authentication.HMACSecret != "" {
+		authenticators = append(authenticators, NewHMACAuthenticator(config.Authentication.HMACSecret))
+	}
+
+	if config.Authentication.HMACSecretFile != "" {
+		auth, err := ReadHMACAuthenticator(config.Authentication.HMACSecretFile)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, auth)
+	}
+
+	return authenticators, nil
+}
+
+// getIdentity returns the (qualified) identity of an authenticated client, or an empty string if the request was
+// not authenticated.
+func getIdentity(r *http.Request) string {
+	if identity, ok := r.Context().Value(identityKey).(string); ok {
+		return identity
+	}
+	return ""
+}
+
+// AuthenticationMiddleware returns HTTP middleware that authenticates the bearer token of a request with
+// each of the supplied Authenticators (in order), and adds the (qualified) identity of the client to the request
+// context.  A request without an Authorization header, but with a verified client certificate (see
+// ClientCertificateMiddleware), is authenticated by the certificate alone; One with both is identified by the token.
+// Requests that cannot be authenticated are rejected with a NotAuthorized problem.
+func AuthenticationMiddleware(authenticators []Authenticator, logger *Logger, next http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+
+		if header == "" && getIdentity(r) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !strings.HasPrefix(header, "Bearer ") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kask"`)
+			HTTPError(w, NotAuthorized(r.URL.Path))
+			logger.RequestID(getRequestID(r)).Log(LogWarning, "Request without bearer token")
+			return
+		}
+
+		token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+
+		for _, auth := range authenticators {
+			if identity, ok := auth.Authenticate(token); ok {
+				ctx := context.WithValue(r.Context(), identityKey, qualifyIdentity(auth.Source(), identity))
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+		}
+
+		w.Header().Set("WWW-Authenticate", `Bearer realm="kask", error="invalid_token"`)
+		HTTPError(w, NotAuthorized(r.URL.Path))
+		logger.RequestID(getRequestID(r)).Log(LogWarning, "Request with invalid bearer token")
+	})
+}
+
+// AuthorizationMiddleware returns HTTP middleware that permits only requests matching one of the supplied rules;
+// Rules match when the client identity is that of the rule, the method is one of the rule's methods, and the key
+// begins with one of the rule's prefixes.  Requests that match no rule are rejected with a Forbidden problem.
+// This middleware must follow ValidatingKeyParserMiddleware (and authentication) in the chain.
+func AuthorizationMiddleware(rules []AuthorizationRule, logger *Logger, next http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := getIdentity(r)
+		key := r.Context().Value(kaskKey).(string)
+
+		for _, rule := range rules {
+			if rule.Permits(identity, r.Method, key) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		HTTPError(w, Forbidden(r.URL.Path))
+		logger.RequestID(getRequestID(r)).Log(LogWarning, "Client %q not permitted to %s key %q", identity, r.Method, key)
+	})
+}
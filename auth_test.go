@@ -0,0 +1,282 @@
+//go:build unit
+// +build unit
+
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+const hmacSecret = "0123456789abcdef0123456789abcdef"
+
+func writeTempFile(t *testing.T, data string) string {
+	file, err := ioutil.TempFile("", "kask")
+	if err != nil {
+		t.Fatalf("Unable to create temporary file: %s", err)
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(data); err != nil {
+		t.Fatalf("Unable to write temporary file: %s", err)
+	}
+	return file.Name()
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	filename := writeTempFile(t, "# Comment\n\nmediawiki s3cr3t\nmonitoring  t0k3n \n")
+	defer os.Remove(filename)
+
+	auth, err := NewTokenAuthenticator(filename)
+	if err != nil {
+		t.Fatalf("Unable to create TokenAuthenticator: %s", err)
+	}
+
+	testCases := []struct {
+		token    string
+		identity string
+		ok       bool
+	}{
+		{"s3cr3t", "mediawiki", true},
+		{"t0k3n", "monitoring", true},
+		{"s3cr3", "", false},
+		{"", "", false},
+	}
+	for _, tc := range testCases {
+		identity, ok := auth.Authenticate(tc.token)
+		AssertEquals(t, tc.ok, ok, "Incorrect authentication result")
+		AssertEquals(t, tc.identity, identity, "Incorrect identity")
+	}
+
+	t.Run("Malformed", func(t *testing.T) {
+		for _, data := range []string{"mediawiki\n", "mediawiki a b\n", "a x\na y\n", "a x\nb x\n"} {
+			filename := writeTempFile(t, data)
+			defer os.Remove(filename)
+
+			if _, err := NewTokenAuthenticator(filename); err == nil {
+				t.Errorf("Malformed tokens file (%q) expected to fail!", data)
+			}
+		}
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		if err := ioutil.WriteFile(filename, []byte("mediawiki n3wt0k3n\n"), 0600); err != nil {
+			t.Fatalf("Unable to write tokens file: %s", err)
+		}
+		if err := auth.Reload(); err != nil {
+			t.Fatalf("Unable to reload tokens: %s", err)
+		}
+
+		_, ok := auth.Authenticate("s3cr3t")
+		AssertEquals(t, false, ok, "Replaced token still valid")
+		identity, _ := auth.Authenticate("n3wt0k3n")
+		AssertEquals(t, "mediawiki", identity, "Incorrect identity")
+
+		// A malformed file leaves the current tokens in place.
+		if err := ioutil.WriteFile(filename, []byte("mediawiki\n"), 0600); err != nil {
+			t.Fatalf("Unable to write tokens file: %s", err)
+		}
+		if err := auth.Reload(); err == nil {
+			t.Errorf("Reload of malformed tokens file expected to fail!")
+		}
+		identity, _ = auth.Authenticate("n3wt0k3n")
+		AssertEquals(t, "mediawiki", identity, "Incorrect identity")
+	})
+}
+
+func TestHMACAuthenticator(t *testing.T) {
+	auth := NewHMACAuthenticator(hmacSecret)
+	expires := time.Now().Add(time.Hour)
+
+	testCases := []struct {
+		name     string
+		token    string
+		identity string
+		ok       bool
+	}{
+		{"Valid", SignToken(hmacSecret, "mediawiki", expires), "mediawiki", true},
+		{"Identity w/ separator", SignToken(hmacSecret, "urn:mediawiki", expires), "urn:mediawiki", true},
+		{"Expired", SignToken(hmacSecret, "mediawiki", time.Now().Add(-time.Second)), "", false},
+		{"Wrong secret", SignToken("fedcba9876543210fedcba9876543210", "mediawiki", expires), "", false},
+		{"Tampered", "monitoring" + SignToken(hmacSecret, "mediawiki", expires)[len("mediawiki"):], "", false},
+		{"Malformed", "mediawiki", "", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			identity, ok := auth.Authenticate(tc.token)
+			AssertEquals(t, tc.ok, ok, "Incorrect authentication result")
+			AssertEquals(t, tc.identity, identity, "Incorrect identity")
+		})
+	}
+}
+
+func TestHMACAuthenticatorFile(t *testing.T) {
+	filename := writeTempFile(t, hmacSecret+"\n")
+	defer os.Remove(filename)
+
+	auth, err := ReadHMACAuthenticator(filename)
+	if err != nil {
+		t.Fatalf("Unable to create HMACAuthenticator: %s", err)
+	}
+
+	expires := time.Now().Add(time.Hour)
+	identity, _ := auth.Authenticate(SignToken(hmacSecret, "mediawiki", expires))
+	AssertEquals(t, "mediawiki", identity, "Incorrect identity")
+
+	// Rotate the secret
+	rotated := "fedcba9876543210fedcba9876543210"
+	if err := ioutil.WriteFile(filename, []byte(rotated), 0600); err != nil {
+		t.Fatalf("Unable to write secret file: %s", err)
+	}
+	if err := auth.Reload(); err != nil {
+		t.Fatalf("Unable to reload secret: %s", err)
+	}
+
+	_, ok := auth.Authenticate(SignToken(hmacSecret, "mediawiki", expires))
+	AssertEquals(t, false, ok, "Token signed with the previous secret still valid")
+	identity, _ = auth.Authenticate(SignToken(rotated, "mediawiki", expires))
+	AssertEquals(t, "mediawiki", identity, "Incorrect identity")
+
+	// Secrets of insufficient length are rejected (leaving the current secret in place).
+	if err := ioutil.WriteFile(filename, []byte("tooshort"), 0600); err != nil {
+		t.Fatalf("Unable to write secret file: %s", err)
+	}
+	if err := auth.Reload(); err == nil {
+		t.Errorf("Reload of short HMAC secret expected to fail!")
+	}
+	identity, _ = auth.Authenticate(SignToken(rotated, "mediawiki", expires))
+	AssertEquals(t, "mediawiki", identity, "Incorrect identity")
+}
+
+func TestAuthenticationMiddleware(t *testing.T) {
+	logger, err := NewLogger(ioutil.Discard, "kask", "info")
+	if err != nil {
+		t.Fatalf("Unable to create Logger instance: %s", err)
+	}
+
+	var identity string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity = getIdentity(r)
+	})
+	middleware := AuthenticationMiddleware([]Authenticator{NewHMACAuthenticator(hmacSecret)}, logger, handler)
+
+	valid := "Bearer " + SignToken(hmacSecret, "mediawiki", time.Now().Add(time.Hour))
+	invalid := "Bearer " + SignToken(hmacSecret, "mediawiki", time.Now().Add(-time.Hour))
+
+	testCases := []struct {
+		name          string
+		authorization string
+		certificate   string
+		statusCode    int
+		identity      string
+	}{
+		{"Valid token", valid, "", 200, "hmac:mediawiki"},
+		{"Invalid token", invalid, "", 401, ""},
+		{"Basic auth", "Basic bWVkaWF3aWtpOnMzY3IzdA==", "", 401, ""},
+		{"No token", "", "", 401, ""},
+		// A verified client certificate suffices, but a token presented along with one must be valid (and is used).
+		{"Certificate w/o token", "", "cert:mediawiki", 200, "cert:mediawiki"},
+		{"Certificate w/ valid token", valid, "cert:mw1001.eqiad.wmnet", 200, "hmac:mediawiki"},
+		{"Certificate w/ invalid token", invalid, "cert:mw1001.eqiad.wmnet", 401, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			identity = ""
+
+			req := httptest.NewRequest("GET", path.Join(prefixURI, "cat"), nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			if tc.certificate != "" {
+				req = req.WithContext(context.WithValue(req.Context(), identityKey, tc.certificate))
+			}
+			rr := httptest.NewRecorder()
+
+			middleware.ServeHTTP(rr, req)
+
+			AssertEquals(t, tc.statusCode, rr.Code, "Incorrect status code")
+			AssertEquals(t, tc.identity, identity, "Incorrect identity")
+			if tc.statusCode == 401 && rr.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("Missing WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestAuthorizationMiddleware(t *testing.T) {
+	logger, err := NewLogger(ioutil.Discard, "kask", "info")
+	if err != nil {
+		t.Fatalf("Unable to create Logger instance: %s", err)
+	}
+
+	rules := []AuthorizationRule{
+		{Identity: "token:mediawiki", Prefixes: []string{"mw:", "global:"}, Methods: []string{"GET", "POST", "DELETE"}},
+		{Identity: "token:echo", Prefixes: []string{"echo:"}, Methods: []string{"GET", "POST"}},
+		{Identity: "token:echo", Prefixes: []string{"global:"}, Methods: []string{"GET"}},
+		{Identity: "cert:admin.example.org", Prefixes: []string{""}, Methods: []string{"DELETE"}},
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	authorizer := AuthorizationMiddleware(rules, logger, handler)
+
+	testCases := []struct {
+		identity   string
+		method     string
+		key        string
+		statusCode int
+	}{
+		{"token:mediawiki", "GET", "mw:cat", 200},
+		{"token:mediawiki", "DELETE", "global:cat", 200},
+		{"token:mediawiki", "GET", "echo:cat", 403},
+		{"token:echo", "POST", "echo:cat", 200},
+		{"token:echo", "GET", "global:cat", 200},
+		{"token:echo", "POST", "global:cat", 403},
+		{"token:echo", "DELETE", "echo:cat", 403},
+		{"cert:admin.example.org", "DELETE", "anything", 200},
+		{"cert:admin.example.org", "GET", "anything", 403},
+		// Identities of one source are not those of another
+		{"hmac:mediawiki", "GET", "mw:cat", 403},
+		{"cert:mediawiki", "GET", "mw:cat", 403},
+		{"token:admin.example.org", "DELETE", "anything", 403},
+		{"", "GET", "mw:cat", 403},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s %s %s", tc.identity, tc.method, tc.key), func(t *testing.T) {
+			handler := ValidatingKeyParserMiddleware(prefixURI, authorizer)
+
+			req := httptest.NewRequest(tc.method, path.Join(prefixURI, tc.key), nil)
+			if tc.identity != "" {
+				req = req.WithContext(context.WithValue(req.Context(), identityKey, tc.identity))
+			}
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			AssertEquals(t, tc.statusCode, rr.Code, "Incorrect status code")
+		})
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gocql/gocql"
+)
+
+// HTTPStore is a Store backed by a running instance of Kask (a namespace of), rather than by Cassandra directly.
+// Values are stored with the default TTL of the namespace (the TTLs passed to Set and Touch are ignored), and the
+// TTL of values retrieved is unknown (-1).
+type HTTPStore struct {
+	// URL of the namespace (i.e. https://localhost:8081/sessions/v1/)
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+// NewHTTPStore returns an HTTPStore for the namespace served from baseURL, authenticating with a bearer token (if
+// non-empty).
+func NewHTTPStore(baseURL, token string, client *http.Client) *HTTPStore {
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	return &HTTPStore{baseURL: baseURL, token: token, client: client}
+}
+
+// Set stores a value (with the default TTL of the namespace).
+func (s *HTTPStore) Set(key string, value []byte, ttl int) error {
+	_, err := s.do(http.MethodPost, url.PathEscape(key), value)
+	return err
+}
+
+// Get retrieves a value.
+func (s *HTTPStore) Get(key string) (Datum, error) {
+	value, err := s.do(http.MethodGet, url.PathEscape(key), nil)
+	if err != nil {
+		return Datum{}, err
+	}
+	return Datum{Value: value, TTL: -1}, nil
+}
+
+// Delete removes a value.
+func (s *HTTPStore) Delete(key string) error {
+	_, err := s.do(http.MethodDelete, url.PathEscape(key), nil)
+	return err
+}
+
+// Touch resets the TTL of a value (to the default TTL of the namespace).
+func (s *HTTPStore) Touch(key string, ttl int) error {
+	_, err := s.do(http.MethodPost, url.PathEscape(key)+"/"+actionTouch, nil)
+	return err
+}
+
+// Close is a no-op.
+func (s *HTTPStore) Close() {
+}
+
+// do performs a request (of path, relative to the namespace), and returns the response body.  A 404 response is
+// gocql.ErrNotFound (as it would be from a CassandraStore), and any other error response is returned as an error
+// (including the details of the problem, if any).
+func (s *HTTPStore) do(method, path string, body []byte) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, s.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return nil, gocql.ErrNotFound
+	case res.StatusCode >= 400:
+		var problem Problem
+		if json.Unmarshal(data, &problem) != nil || problem.Title == "" {
+			return nil, errors.New(res.Status)
+		}
+		return nil, fmt.Errorf("%s: %s (%s)", res.Status, problem.Title, problem.Detail)
+	}
+
+	return data, nil
+}
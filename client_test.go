@@ -0,0 +1,70 @@
+//go:build unit
+// +build unit
+
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gocql/gocql"
+)
+
+func TestHTTPStore(t *testing.T) {
+	handler, backend := setUpTesting(t)
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	store := NewHTTPStore(server.URL+prefixURI, "", server.Client())
+	defer store.Close()
+
+	if err := store.Set("key", []byte("value"), 0); err != nil {
+		t.Fatalf("Unable to set value: %s", err)
+	}
+
+	datum, err := backend.Get("key")
+	if err != nil {
+		t.Fatalf("Value not stored: %s", err)
+	}
+	AssertEquals(t, "value", string(datum.Value), "Incorrect value stored")
+
+	if datum, err = store.Get("key"); err != nil {
+		t.Fatalf("Unable to get value: %s", err)
+	}
+	AssertEquals(t, "value", string(datum.Value), "Incorrect value")
+	AssertEquals(t, -1, datum.TTL, "Incorrect (unknown) TTL")
+
+	if err := store.Touch("key", 0); err != nil {
+		t.Fatalf("Unable to touch value: %s", err)
+	}
+
+	if err := store.Delete("key"); err != nil {
+		t.Fatalf("Unable to delete value: %s", err)
+	}
+
+	_, err = store.Get("key")
+	AssertEquals(t, gocql.ErrNotFound, err, "Incorrect error for missing key")
+
+	// Problems are returned as errors
+	if err := store.Set("key", []byte{}, 0); err == nil {
+		t.Errorf("Empty value expected to fail!")
+	}
+}
@@ -0,0 +1,608 @@
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/gocql/gocql"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Command is a kask subcommand, invoked as `kask [flags] <name> [args...]`.
+type Command struct {
+	Name  string
+	Usage string
+	Run   func(config *Config, logger *Logger, args []string) error
+}
+
+var commands = []Command{
+	{"reencrypt", "reencrypt [namespace...]", reencryptCommand},
+	{"get", "get [-namespace name] [-url url [-token-file file]] <key>", getCommand},
+	{"set", "set [-namespace name] [-url url [-token-file file]] [-file file] [-ttl ttl] <key>", setCommand},
+	{"delete", "delete [-namespace name] [-url url [-token-file file]] <key>", deleteCommand},
+	{"ttl", "ttl [-namespace name] <key>", ttlCommand},
+	{"export", "export [-namespace name] [-file file] [-splits n] [-concurrency n]", exportCommand},
+	{"import", "import [-namespace name] [-file file] [-rate n] [-checkpoint file]", importCommand},
+}
+
+// runCommand executes the named subcommand.
+func runCommand(config *Config, logger *Logger, args []string) error {
+	for _, cmd := range commands {
+		if cmd.Name == args[0] {
+			return cmd.Run(config, logger, args[1:])
+		}
+	}
+
+	usages := []string{fmt.Sprintf("  %s %s", os.Args[0], configCommandUsage)}
+	for _, cmd := range commands {
+		usages = append(usages, fmt.Sprintf("  %s %s", os.Args[0], cmd.Usage))
+	}
+	return fmt.Errorf("unknown command %q; Usage:\n%s", args[0], strings.Join(usages, "\n"))
+}
+
+// selectNamespaces returns the namespaces named, or all of them if none are.
+func selectNamespaces(config *Config, names []string) ([]*Namespace, error) {
+	var selected []*Namespace
+
+	for i := range config.Namespaces {
+		if len(names) == 0 || contains(names, config.Namespaces[i].Name) {
+			selected = append(selected, &config.Namespaces[i])
+		}
+	}
+
+	if len(selected) < len(names) {
+		return nil, fmt.Errorf("one or more unknown namespaces: %s", strings.Join(names, ", "))
+	}
+
+	return selected, nil
+}
+
+// reencryptCommand re-encrypts the values of each namespace (or those named) with the primary key.
+func reencryptCommand(config *Config, logger *Logger, args []string) error {
+	if config.Encryption.Keyring == "" {
+		return errors.New("encryption is not configured (no keyring)")
+	}
+
+	keyring, err := ReadKeyring(config.Encryption.Keyring)
+	if err != nil {
+		return err
+	}
+
+	namespaces, err := selectNamespaces(config, args)
+	if err != nil {
+		return err
+	}
+
+	session, err := createSession(config)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	for _, ns := range namespaces {
+		store, err := NewCassandraStore(session, ns)
+		if err != nil {
+			return err
+		}
+
+		logger.Info("Re-encrypting namespace %s with key %q...", ns.Name, keyring.Primary())
+
+		stats, err := Reencrypt(store, keyring, logger)
+		if err != nil {
+			return fmt.Errorf("re-encryption of namespace %s failed: %s", ns.Name, err)
+		}
+
+		logger.Info("Re-encrypted namespace %s: %d scanned, %d re-encrypted, %d conflicts, %d errors",
+			ns.Name, stats.Scanned, stats.Reencrypted, stats.Conflicts, stats.Errors)
+
+		if stats.Errors > 0 {
+			return fmt.Errorf("%d values of namespace %s could not be re-encrypted", stats.Errors, ns.Name)
+		}
+	}
+
+	return nil
+}
+
+// clientFlags are the flags common to the get, set, delete, and ttl commands.
+type clientFlags struct {
+	*flag.FlagSet
+	namespace string
+	url       string
+	tokenFile string
+}
+
+// newClientFlags returns the flags of a client command, for parsing its arguments.
+func newClientFlags(name string) *clientFlags {
+	flags := &clientFlags{FlagSet: flag.NewFlagSet(name, flag.ContinueOnError)}
+	flags.StringVar(&flags.namespace, "namespace", "", "Name of the namespace (defaults to the first configured)")
+	flags.StringVar(&flags.url, "url", "", "URL of a running kask (i.e. https://localhost:8081), rather than accessing Cassandra directly")
+	flags.StringVar(&flags.tokenFile, "token-file", "", "File containing a bearer token (when accessing kask over HTTP)")
+	return flags
+}
+
+// parse parses the arguments of a client command, which must include exactly one key.
+func (flags *clientFlags) parse(args []string) (string, error) {
+	if err := flags.Parse(args); err != nil {
+		return "", err
+	}
+	if flags.NArg() != 1 {
+		return "", fmt.Errorf("%s requires exactly one key", flags.Name())
+	}
+	return flags.Arg(0), nil
+}
+
+// commandNamespace returns the namespace named, or the first configured if name is empty.
+func commandNamespace(config *Config, name string) (*Namespace, error) {
+	if name == "" {
+		return &config.Namespaces[0], nil
+	}
+	namespaces, err := selectNamespaces(config, []string{name})
+	if err != nil {
+		return nil, err
+	}
+	return namespaces[0], nil
+}
+
+// openStore returns the Store of the namespace; Either that of a running kask (if a URL was given), or of Cassandra
+// (in which case the sessions, including that of any cluster being migrated from, are closed along with the Store).
+func (flags *clientFlags) openStore(config *Config, logger *Logger) (Store, *Namespace, error) {
+	ns, err := commandNamespace(config, flags.namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if flags.url != "" {
+		var token string
+		if flags.tokenFile != "" {
+			if token, err = readSecretFile(flags.tokenFile); err != nil {
+				return nil, nil, err
+			}
+		}
+		return NewHTTPStore(strings.TrimSuffix(flags.url, "/")+ns.BaseURI, token, http.DefaultClient), ns, nil
+	}
+
+	var keyring *Keyring
+	if config.Encryption.Keyring != "" {
+		if keyring, err = ReadKeyring(config.Encryption.Keyring); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	session, err := createSession(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	oldSession, err := createMigrationSession(config)
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+
+	store, err := newStore(config, session, oldSession, ns, keyring, logger)
+	if err != nil {
+		session.Close()
+		if oldSession != nil {
+			oldSession.Close()
+		}
+		return nil, nil, err
+	}
+
+	// The session of the cluster being migrated from is closed along with the Store, as is its own.
+	if oldSession != nil {
+		store = &sessionClosingStore{store, oldSession}
+	}
+
+	return store, ns, nil
+}
+
+// sessionClosingStore is a Store that closes a session (in addition to those of the Store) when closed.
+type sessionClosingStore struct {
+	Store
+	session *gocql.Session
+}
+
+// Close closes the Store, and then the session.
+func (s *sessionClosingStore) Close() {
+	s.Store.Close()
+	s.session.Close()
+}
+
+// getCommand writes the value of a key to stdout.
+func getCommand(config *Config, logger *Logger, args []string) error {
+	flags := newClientFlags("get")
+	key, err := flags.parse(args)
+	if err != nil {
+		return err
+	}
+
+	store, _, err := flags.openStore(config, logger)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	datum, err := store.Get(key)
+	if err != nil {
+		return keyError(key, err)
+	}
+
+	_, err = os.Stdout.Write(datum.Value)
+	return err
+}
+
+// setCommand stores the value of a key, read from a file (or stdin).
+func setCommand(config *Config, logger *Logger, args []string) error {
+	flags := newClientFlags("set")
+	file := flags.String("file", "-", "File containing the value (- for stdin)")
+	ttlFlag := flags.String("ttl", "", "TTL of the value, in seconds or as a duration, i.e. 1d (defaults to that of the namespace)")
+	key, err := flags.parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *ttlFlag != "" && flags.url != "" {
+		return errors.New("-ttl is not supported over HTTP (values are stored with the default TTL of the namespace)")
+	}
+
+	var value []byte
+	if *file == "-" {
+		value, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		value, err = ioutil.ReadFile(*file)
+	}
+	if err != nil {
+		return err
+	}
+
+	store, ns, err := flags.openStore(config, logger)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	ttl := ns.DefaultTTL
+	if *ttlFlag != "" {
+		if err := yaml.Unmarshal([]byte(*ttlFlag), &ttl); err != nil {
+			return err
+		}
+		if ttl < 0 {
+			return errors.New("-ttl must be a positive integer")
+		}
+	}
+
+	return store.Set(key, value, int(ttl))
+}
+
+// deleteCommand removes a key.
+func deleteCommand(config *Config, logger *Logger, args []string) error {
+	flags := newClientFlags("delete")
+	key, err := flags.parse(args)
+	if err != nil {
+		return err
+	}
+
+	store, _, err := flags.openStore(config, logger)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	return store.Delete(key)
+}
+
+// ttlCommand writes the remaining TTL (in seconds; 0 if the value never expires) of a key to stdout.
+func ttlCommand(config *Config, logger *Logger, args []string) error {
+	flags := newClientFlags("ttl")
+	key, err := flags.parse(args)
+	if err != nil {
+		return err
+	}
+
+	// Kask does not expose TTLs over HTTP.
+	if flags.url != "" {
+		return errors.New("ttl is not supported over HTTP")
+	}
+
+	store, _, err := flags.openStore(config, logger)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	datum, err := store.Get(key)
+	if err != nil {
+		return keyError(key, err)
+	}
+
+	_, err = fmt.Println(datum.TTL)
+	return err
+}
+
+// openCassandraStore returns the (Cassandra) Store of the namespace named (or the first, if name is empty); Values
+// are as stored (i.e. encrypted and compressed, if so-configured).  The session is closed along with the Store.
+func openCassandraStore(config *Config, name string) (*CassandraStore, error) {
+	ns, err := commandNamespace(config, name)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := createSession(config)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := NewCassandraStore(session, ns)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// exportCommand writes the values of a namespace to a file (or stdout), as NDJSON records.
+func exportCommand(config *Config, logger *Logger, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	namespace := flags.String("namespace", "", "Name of the namespace (defaults to the first configured)")
+	file := flags.String("file", "-", "File to write (- for stdout)")
+	splits := flags.Int("splits", 256, "Number of token ranges to divide the table into")
+	concurrency := flags.Int("concurrency", 4, "Number of token ranges to scan concurrently")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *splits < 1 || *concurrency < 1 {
+		return errors.New("-splits and -concurrency must be greater than zero")
+	}
+
+	store, err := openCassandraStore(config, *namespace)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	out := os.Stdout
+	if *file != "-" {
+		if out, err = os.Create(*file); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	writer := bufio.NewWriter(out)
+
+	logger.Info("Exporting %s.%s (%d token ranges, %d concurrently)...", store.Keyspace, store.Table, *splits, *concurrency)
+
+	stats, err := Export(store, writer, *splits, *concurrency, logger)
+	if err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	logger.Info("Exported %d records of %s.%s", stats.Exported, store.Keyspace, store.Table)
+
+	return nil
+}
+
+// importCommand writes the NDJSON records of a file (or stdin) to a namespace.
+func importCommand(config *Config, logger *Logger, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	namespace := flags.String("namespace", "", "Name of the namespace (defaults to the first configured)")
+	file := flags.String("file", "-", "File to read (- for stdin)")
+	rate := flags.Int("rate", 0, "Maximum records written per second (0 is unlimited)")
+	checkpoint := flags.String("checkpoint", "", "File recording progress, from which an interrupted import is resumed")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *rate < 0 {
+		return errors.New("-rate must be a positive integer")
+	}
+
+	in := os.Stdin
+	if *file != "-" {
+		var err error
+		if in, err = os.Open(*file); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+
+	store, err := openCassandraStore(config, *namespace)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	logger.Info("Importing into %s.%s...", store.Keyspace, store.Table)
+
+	stats, err := NewImporter(store, *rate, *checkpoint, logger).Import(in)
+	if err != nil {
+		return fmt.Errorf("import failed after %d records: %s", stats.Imported, err)
+	}
+
+	logger.Info("Imported %d records into %s.%s (%d expired, %d skipped, per the checkpoint)", stats.Imported, store.Keyspace, store.Table, stats.Expired, stats.Skipped)
+
+	return nil
+}
+
+// keyError returns a (more) descriptive error for a key that was not found.
+func keyError(key string, err error) error {
+	if err == gocql.ErrNotFound {
+		return fmt.Errorf("key %q not found", key)
+	}
+	return err
+}
+
+const configCommandUsage = "config check [-files]"
+
+// ConfigCheck is the (JSON serializable) result of `kask config check`.
+type ConfigCheck struct {
+	File  string      `json:"file"`
+	Valid bool        `json:"valid"`
+	Error string      `json:"error,omitempty"`
+	Files []FileCheck `json:"files,omitempty"`
+}
+
+// FileCheck is the result of verifying that a file referenced by the configuration exists, and can be parsed.
+type FileCheck struct {
+	Setting string `json:"setting"`
+	Path    string `json:"path"`
+	Valid   bool   `json:"valid"`
+	Error   string `json:"error,omitempty"`
+}
+
+// configCommand executes a subcommand of `kask config`, writing its results to out, and returning the exit status.
+// Unlike other subcommands, these operate on the configuration file, and so are executed before (and instead of)
+// loading it.
+func configCommand(filename string, args []string, out io.Writer) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s\n", os.Args[0], configCommandUsage)
+		return 2
+	}
+
+	flags := flag.NewFlagSet("config check", flag.ContinueOnError)
+	checkFiles := flags.Bool("files", false, "Verify that the files referenced (certificates, keys, etc) exist and parse")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	result := CheckConfig(filename, *checkFiles)
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(result); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to serialize results: %s\n", err)
+		return 1
+	}
+
+	if !result.Valid {
+		return 1
+	}
+	return 0
+}
+
+// CheckConfig reads and validates a configuration file, and (if checkFiles is true) the files it references.  The
+// configuration is valid only if they all are.
+func CheckConfig(filename string, checkFiles bool) ConfigCheck {
+	result := ConfigCheck{File: filename, Valid: true}
+
+	config, err := ReadConfig(filename)
+	if err != nil {
+		result.Valid, result.Error = false, err.Error()
+		return result
+	}
+
+	if !checkFiles {
+		return result
+	}
+
+	check := func(setting, path string, verify func() error) {
+		if path == "" {
+			return
+		}
+		file := FileCheck{Setting: setting, Path: path, Valid: true}
+		if err := verify(); err != nil {
+			file.Valid, file.Error = false, err.Error()
+			result.Valid = false
+		}
+		result.Files = append(result.Files, file)
+	}
+
+	check("tls.cert", config.TLS.CertPath, func() error {
+		_, err := tls.LoadX509KeyPair(config.TLS.CertPath, config.TLS.KeyPath)
+		return err
+	})
+	check("tls.client_ca", config.TLS.ClientCAPath, func() error { return checkCertificates(config.TLS.ClientCAPath) })
+	check("openapi_spec", config.OpenAPISpec, func() error { return checkOpenAPISpec(config) })
+	check("authentication.tokens_file", config.Authentication.TokensFile, func() error {
+		_, err := readTokens(config.Authentication.TokensFile)
+		return err
+	})
+	check("authentication.hmac_secret_file", config.Authentication.HMACSecretFile, func() error {
+		_, err := ReadHMACAuthenticator(config.Authentication.HMACSecretFile)
+		return err
+	})
+	check("encryption.keyring", config.Encryption.Keyring, func() error {
+		_, err := ReadKeyring(config.Encryption.Keyring)
+		return err
+	})
+
+	checkCassandra := func(prefix string, cassandra *CassandraConfig) {
+		check(prefix+".tls.ca", cassandra.TLS.CaPath, func() error { return checkCertificates(cassandra.TLS.CaPath) })
+		check(prefix+".tls.cert", cassandra.TLS.CertPath, func() error {
+			_, err := tls.LoadX509KeyPair(cassandra.TLS.CertPath, cassandra.TLS.KeyPath)
+			return err
+		})
+		check(prefix+".authentication.password_file", cassandra.Authentication.PasswordFile, func() error {
+			_, err := readSecretFile(cassandra.Authentication.PasswordFile)
+			return err
+		})
+	}
+	checkCassandra("cassandra", &config.Cassandra)
+	if config.Migration.Enabled {
+		checkCassandra("migration.cassandra", &config.Migration.Cassandra)
+	}
+
+	return result
+}
+
+// checkCertificates verifies that a file contains (one or more) PEM encoded certificates.
+func checkCertificates(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates found in %s", filename)
+	}
+	return nil
+}
+
+// checkOpenAPISpec verifies that the OpenAPI specification can be templated (as it is when served), and that the
+// result is valid YAML.
+func checkOpenAPISpec(config *Config) error {
+	tmpl, err := template.New(path.Base(config.OpenAPISpec)).ParseFiles(config.OpenAPISpec)
+	if err != nil {
+		return err
+	}
+
+	var spec bytes.Buffer
+	if err := tmpl.Execute(&spec, config); err != nil {
+		return err
+	}
+
+	var doc interface{}
+	return yaml.Unmarshal(spec.Bytes(), &doc)
+}
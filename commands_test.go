@@ -0,0 +1,96 @@
+//go:build unit
+// +build unit
+
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCheckConfig(t *testing.T) {
+	certFile, keyFile := generateCertificate(t, "localhost", time.Now().Add(time.Hour))
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+
+	t.Run("Valid", func(t *testing.T) {
+		filename := writeTempFile(t, fmt.Sprintf("tls:\n  cert: %s\n  key: %s\n", certFile, keyFile))
+		defer os.Remove(filename)
+
+		result := CheckConfig(filename, true)
+		AssertEquals(t, true, result.Valid, "Configuration invalid: "+result.Error)
+		AssertEquals(t, 1, len(result.Files), "Incorrect number of files checked")
+		AssertEquals(t, "tls.cert", result.Files[0].Setting, "Incorrect setting")
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		filename := writeTempFile(t, "listen_port: 100000\n")
+		defer os.Remove(filename)
+
+		var out bytes.Buffer
+		AssertEquals(t, 1, configCommand(filename, []string{"check"}, &out), "Incorrect exit status")
+
+		var result ConfigCheck
+		if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+			t.Fatalf("Unable to deserialize results: %s", err)
+		}
+		AssertEquals(t, false, result.Valid, "Invalid configuration reported valid")
+		AssertEquals(t, "Invalid listen_port: 100000 (must be 0-65535)", result.Error, "Incorrect error")
+	})
+
+	t.Run("Missing file", func(t *testing.T) {
+		filename := writeTempFile(t, "encryption:\n  keyring: /nonexistent/keyring.yaml\n")
+		defer os.Remove(filename)
+
+		// Files are only checked if requested
+		AssertEquals(t, true, CheckConfig(filename, false).Valid, "Configuration invalid")
+
+		result := CheckConfig(filename, true)
+		AssertEquals(t, false, result.Valid, "Missing keyring reported valid")
+		AssertEquals(t, 1, len(result.Files), "Incorrect number of files checked")
+		AssertEquals(t, false, result.Files[0].Valid, "Missing keyring reported valid")
+	})
+
+	t.Run("Migration", func(t *testing.T) {
+		data := "migration:\n  enabled: %t\n  cassandra:\n    hosts: [old]\n    tls:\n      ca: %s\n      cert: %s\n      key: %s\n    authentication:\n      username: kask\n      password_file: /nonexistent/password\n"
+
+		// Files of the old cluster are checked only if migration is enabled
+		filename := writeTempFile(t, fmt.Sprintf(data, false, certFile, certFile, keyFile))
+		defer os.Remove(filename)
+		result := CheckConfig(filename, true)
+		AssertEquals(t, true, result.Valid, "Configuration invalid: "+result.Error)
+		AssertEquals(t, 0, len(result.Files), "Incorrect number of files checked")
+
+		filename = writeTempFile(t, fmt.Sprintf(data, true, certFile, certFile, keyFile))
+		defer os.Remove(filename)
+		result = CheckConfig(filename, true)
+		AssertEquals(t, false, result.Valid, "Missing password file reported valid")
+		AssertEquals(t, 3, len(result.Files), "Incorrect number of files checked")
+		for _, file := range result.Files[:2] {
+			AssertEquals(t, true, file.Valid, "File invalid: "+file.Setting)
+		}
+		AssertEquals(t, "migration.cassandra.authentication.password_file", result.Files[2].Setting, "Incorrect setting")
+		AssertEquals(t, false, result.Files[2].Valid, "Missing password file reported valid")
+	})
+}
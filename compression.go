@@ -0,0 +1,149 @@
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Compressed values are stored as: magic, followed by a zstd frame.  Values without the magic prefix are
+// stored uncompressed, except those that would be mistaken for compressed (or escaped) values; These are stored
+// escaped, prefixed with escapeMagic.
+var (
+	compressionMagic = []byte("KASK\x02")
+	escapeMagic      = []byte("KASK\x00")
+)
+
+// maxDecompressedSize bounds the size of decompressed values, when not otherwise limited (see max_value_size).
+const maxDecompressedSize = 64 * 1024 * 1024
+
+// CompressedGetter is implemented by Stores that can return values in their compressed form.
+type CompressedGetter interface {
+	// GetCompressed retrieves a value associated with a key, and the (HTTP) content-coding of it; Values
+	// stored compressed are returned as-is, with the coding "zstd".  Others are returned with an empty coding.
+	GetCompressed(string) (Datum, string, error)
+}
+
+// CompressingStore is a Store that compresses values (with zstd) before passing them to another Store.  Values
+// smaller than a threshold, or that do not compress, are stored as-is (or escaped; See escapeMagic).
+type CompressingStore struct {
+	next      Store
+	threshold int
+	ratio     prometheus.Observer
+	encoder   *zstd.Encoder
+	decoder   *zstd.Decoder
+}
+
+// NewCompressingStore returns a CompressingStore that wraps next, compressing values of threshold bytes or
+// more, and observing the compression ratio (compressed size / uncompressed size) of each.  Values that would
+// decompress to more than maxSize bytes (or maxDecompressedSize, if maxSize is 0) are an error.
+func NewCompressingStore(next Store, threshold, maxSize int, ratio prometheus.Observer) (*CompressingStore, error) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxSize <= 0 {
+		maxSize = maxDecompressedSize
+	}
+
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(maxSize)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &CompressingStore{next, threshold, ratio, encoder, decoder}, nil
+}
+
+// Set compresses a value (if warranted), and stores it.
+func (s *CompressingStore) Set(key string, value []byte, ttl int) error {
+	if len(value) < s.threshold {
+		return s.next.Set(key, escape(value), ttl)
+	}
+
+	compressed := s.encoder.EncodeAll(value, append([]byte{}, compressionMagic...))
+
+	s.ratio.Observe(float64(len(compressed)) / float64(len(value)))
+
+	if len(compressed) >= len(value) {
+		return s.next.Set(key, escape(value), ttl)
+	}
+
+	return s.next.Set(key, compressed, ttl)
+}
+
+// escape returns a value to be stored uncompressed; Those beginning with either magic are prefixed with escapeMagic.
+func escape(value []byte) []byte {
+	if !bytes.HasPrefix(value, compressionMagic) && !bytes.HasPrefix(value, escapeMagic) {
+		return value
+	}
+	return append(append([]byte{}, escapeMagic...), value...)
+}
+
+// Get retrieves a value, decompressing it if necessary.
+func (s *CompressingStore) Get(key string) (Datum, error) {
+	datum, encoding, err := s.GetCompressed(key)
+	if err != nil || encoding == "" {
+		return datum, err
+	}
+
+	if datum.Value, err = s.decoder.DecodeAll(datum.Value, nil); err != nil {
+		return Datum{}, err
+	}
+
+	return datum, nil
+}
+
+// GetCompressed retrieves a value, without decompressing it.
+func (s *CompressingStore) GetCompressed(key string) (Datum, string, error) {
+	datum, err := s.next.Get(key)
+	if err != nil {
+		return datum, "", err
+	}
+
+	if bytes.HasPrefix(datum.Value, escapeMagic) {
+		datum.Value = datum.Value[len(escapeMagic):]
+		return datum, "", nil
+	}
+
+	if !bytes.HasPrefix(datum.Value, compressionMagic) {
+		return datum, "", nil
+	}
+
+	datum.Value = datum.Value[len(compressionMagic):]
+
+	return datum, "zstd", nil
+}
+
+// Delete removes a value.
+func (s *CompressingStore) Delete(key string) error {
+	return s.next.Delete(key)
+}
+
+// Touch resets the TTL of a value (the compressed value is rewritten as-is).
+func (s *CompressingStore) Touch(key string, ttl int) error {
+	return s.next.Touch(key, ttl)
+}
+
+// Close closes the wrapped Store.
+func (s *CompressingStore) Close() {
+	s.next.Close()
+}
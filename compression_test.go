@@ -0,0 +1,169 @@
+//go:build unit
+// +build unit
+
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestCompressingStore(t *testing.T, threshold int) (*CompressingStore, *mockStore) {
+	return newTestCompressingStoreMaxSize(t, threshold, 0)
+}
+
+func newTestCompressingStoreMaxSize(t *testing.T, threshold, maxSize int) (*CompressingStore, *mockStore) {
+	backend := newMockStore()
+	ratio := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_compression_ratio"})
+
+	store, err := NewCompressingStore(backend, threshold, maxSize, ratio)
+	if err != nil {
+		t.Fatalf("Unable to create CompressingStore: %s", err)
+	}
+	return store, backend
+}
+
+func TestCompressingStore(t *testing.T) {
+	store, backend := newTestCompressingStore(t, 64)
+	compressible := []byte(strings.Repeat("meow", 64))
+
+	testCases := []struct {
+		name       string
+		value      []byte
+		compressed bool
+	}{
+		{"Below threshold", []byte("meow"), false},
+		{"Compressible", compressible, true},
+		{"Incompressible", []byte(RandString(64)), false},
+		{"Magic", append(append([]byte{}, compressionMagic...), "meow"...), false},
+		{"Escape magic", append(append([]byte{}, escapeMagic...), "meow"...), false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := store.Set(tc.name, tc.value, 60); err != nil {
+				t.Fatalf("Error storing value: %s", err)
+			}
+
+			AssertEquals(t, tc.compressed, bytes.HasPrefix(backend.data[tc.name].Value, compressionMagic), "Value compressed")
+
+			datum, err := store.Get(tc.name)
+			if err != nil {
+				t.Fatalf("Error retrieving value: %s", err)
+			}
+			AssertEquals(t, string(tc.value), string(datum.Value), "Incorrect value")
+			AssertEquals(t, 60, datum.TTL, "Incorrect TTL")
+		})
+	}
+
+	t.Run("GetCompressed", func(t *testing.T) {
+		datum, encoding, err := store.GetCompressed("Compressible")
+		if err != nil {
+			t.Fatalf("Error retrieving value: %s", err)
+		}
+		AssertEquals(t, "zstd", encoding, "Incorrect content-coding")
+
+		decoder, _ := zstd.NewReader(nil)
+		value, err := decoder.DecodeAll(datum.Value, nil)
+		if err != nil {
+			t.Fatalf("Value is not a zstd frame: %s", err)
+		}
+		AssertEquals(t, string(compressible), string(value), "Incorrect value")
+
+		if _, encoding, _ = store.GetCompressed("Below threshold"); encoding != "" {
+			t.Errorf("Uncompressed value returned with content-coding %q", encoding)
+		}
+	})
+}
+
+func TestDecompressedSizeLimit(t *testing.T) {
+	store, _ := newTestCompressingStoreMaxSize(t, 0, 1024)
+
+	if err := store.Set("small", []byte(strings.Repeat("meow", 64)), 60); err != nil {
+		t.Fatalf("Error storing value: %s", err)
+	}
+	if _, err := store.Get("small"); err != nil {
+		t.Errorf("Error retrieving value: %s", err)
+	}
+
+	if err := store.Set("large", []byte(strings.Repeat("meow", 1024)), 60); err != nil {
+		t.Fatalf("Error storing value: %s", err)
+	}
+	if _, err := store.Get("large"); err == nil {
+		t.Errorf("Expected an error decompressing a value larger than the limit")
+	}
+}
+
+func TestGetCompressed(t *testing.T) {
+	config, err := NewConfig([]byte{})
+	if err != nil {
+		t.Fatalf("Unable to create Config instance: %s", err)
+	}
+	logger, err := NewLogger(ioutil.Discard, config.ServiceName, config.LogLevel)
+	if err != nil {
+		t.Fatalf("Unable to create Logger instance: %s", err)
+	}
+
+	store, _ := newTestCompressingStore(t, 0)
+	handler := ValidatingKeyParserMiddleware(prefixURI, NewHTTPHandler(store, config, &config.Namespaces[0], logger))
+	value := strings.Repeat("meow", 64)
+
+	store.Set("cat", []byte(value), 60)
+
+	testCases := []struct {
+		acceptEncoding  string
+		contentEncoding string
+	}{
+		{"", ""},
+		{"gzip, zstd", "zstd"},
+		{"gzip, zstd;q=0", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.acceptEncoding, func(t *testing.T) {
+			req := httptest.NewRequest("GET", path.Join(prefixURI, "cat"), nil)
+			if tc.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+			rr := httptest.NewRecorder()
+
+			handler.ServeHTTP(rr, req)
+
+			AssertEquals(t, http.StatusOK, rr.Code, "Incorrect status code")
+			AssertEquals(t, tc.contentEncoding, rr.Header().Get("Content-Encoding"), "Incorrect Content-Encoding")
+			AssertEquals(t, "Accept-Encoding", rr.Header().Get("Vary"), "Incorrect Vary")
+
+			body := rr.Body.Bytes()
+			if tc.contentEncoding == "zstd" {
+				decoder, _ := zstd.NewReader(nil)
+				if body, err = decoder.DecodeAll(body, nil); err != nil {
+					t.Fatalf("Response is not a zstd frame: %s", err)
+				}
+			}
+			AssertEquals(t, value, string(body), "Incorrect value")
+		})
+	}
+}
@@ -21,56 +21,296 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/gocql/gocql"
 	yaml "gopkg.in/yaml.v2"
 )
 
 // Config represents an application-wide configuration.
 type Config struct {
-	ServiceName string `yaml:"service_name"`
-	BaseURI     string `yaml:"base_uri"`
-	Address     string `yaml:"listen_address"`
-	Port        int    `yaml:"listen_port"`
-	DefaultTTL  int    `yaml:"default_ttl"`
-	LogLevel    string `yaml:"log_level"`
-	OpenAPISpec string `yaml:"openapi_spec"`
+	ServiceName string      `yaml:"service_name"`
+	BaseURI     string      `yaml:"base_uri"`
+	Address     string      `yaml:"listen_address"`
+	Port        int         `yaml:"listen_port"`
+	DefaultTTL  Seconds     `yaml:"default_ttl"`
+	LogLevel    string      `yaml:"log_level"`
+	OpenAPISpec string      `yaml:"openapi_spec"`
+	Namespaces  []Namespace `yaml:"namespaces"`
 	TLS         struct {
+		CertPath       string  `yaml:"cert"`
+		KeyPath        string  `yaml:"key"`
+		ClientCAPath   string  `yaml:"client_ca"`
+		ClientAuth     string  `yaml:"client_auth"`
+		ReloadInterval Seconds `yaml:"reload_interval"`
+		// Protocol versions ("1.0" through "1.3"), cipher suites (by IANA name), and curves (i.e. X25519, P-256)
+		// permitted; Go's defaults are used for any not configured.
+		MinVersion     string   `yaml:"min_version"`
+		MaxVersion     string   `yaml:"max_version"`
+		CipherSuites   []string `yaml:"cipher_suites"`
+		Curves         []string `yaml:"curves"`
+		HTTP2          bool     `yaml:"http2"`
+		AllowedClients struct {
+			Read   []string `yaml:"read"`
+			Write  []string `yaml:"write"`
+			Delete []string `yaml:"delete"`
+		} `yaml:"allowed_clients"`
+	}
+	Authentication struct {
+		TokensFile     string `yaml:"tokens_file"`
+		HMACSecret     string `yaml:"hmac_secret" secret:"true"`
+		HMACSecretFile string `yaml:"hmac_secret_file"`
+	}
+	Authorization []AuthorizationRule `yaml:"authorization"`
+	Encryption    struct {
+		Keyring string `yaml:"keyring"`
+	}
+	// Admin listener (optional); When configured, operational endpoints (metrics, health checks, and the OpenAPI
+	// spec) are served from it, rather than from the data listener.  TLS (with the server certificate) is optional.
+	Admin struct {
+		Address string `yaml:"listen_address"`
+		Port    int    `yaml:"listen_port"`
+		TLS     bool   `yaml:"tls"`
+	}
+	// Unix domain socket listener (optional), served (in cleartext) in addition to the TCP listener; Mode is
+	// the (octal) file mode of the socket.
+	Socket struct {
+		Path string `yaml:"path"`
+		Mode string `yaml:"mode"`
+	} `yaml:"listen_socket"`
+	// HTTPServer timeouts and limits
+	HTTPServer HTTPServerConfig `yaml:"http_server"`
+	// HTTPCompression of responses (and request bodies); Responses of at least MinSize bytes are compressed
+	// with gzip or brotli, as negotiated by Accept-Encoding.
+	HTTPCompression struct {
+		Enabled bool `yaml:"enabled"`
+		MinSize int  `yaml:"min_size"`
+	} `yaml:"http_compression"`
+	// Shutdown (on SIGTERM); The service reports itself not-ready for DrainPeriod seconds (while continuing to
+	// serve requests), and then waits up to Timeout seconds for requests in-flight to complete.
+	Shutdown struct {
+		DrainPeriod Seconds `yaml:"drain_period"`
+		Timeout     Seconds `yaml:"timeout"`
+	}
+	// Readiness checks (of Cassandra); Checks must complete within Timeout milliseconds, and their results are
+	// cached for CacheTTL milliseconds.
+	Healthz struct {
+		Timeout  Milliseconds `yaml:"timeout_ms"`
+		CacheTTL Milliseconds `yaml:"cache_ms"`
+	}
+
+	// Migration of values from an old backend (see MigratingStore); Either the same tables of another Cassandra
+	// cluster, or other tables (of either cluster).
+	Migration struct {
+		Enabled bool `yaml:"enabled"`
+		// Copy values found only in the old backend to the new one (with their remaining TTL) when read
+		CopyForward bool `yaml:"copy_forward"`
+		// The old cluster; Defaults to that of Cassandra (if no hosts are configured)
+		Cassandra CassandraConfig `yaml:"cassandra"`
+		// The old tables, by namespace name; Namespaces default to the same keyspace and table
+		Tables map[string]MigrationTable `yaml:"tables"`
+	}
+
+	Cassandra CassandraConfig
+}
+
+// CassandraConfig represents the settings of a Cassandra cluster (and its client).
+type CassandraConfig struct {
+	Hosts          []string     `yaml:"hosts"`
+	Port           int          `yaml:"port"`
+	Keyspace       string       `yaml:"keyspace"`
+	Table          string       `yaml:"table"`
+	LocalDC        string       `yaml:"local_dc"`
+	QueryTimeout   Milliseconds `yaml:"query_timeout_ms"`
+	ConnectTimeout Milliseconds `yaml:"connect_timeout_ms"`
+	TLS            struct {
+		CaPath   string `yaml:"ca"`
 		CertPath string `yaml:"cert"`
 		KeyPath  string `yaml:"key"`
 	}
+	Authentication struct {
+		Username     string `yaml:"username"`
+		Password     string `yaml:"password" secret:"true"`
+		PasswordFile string `yaml:"password_file"`
+	}
+}
 
-	Cassandra struct {
-		Hosts          []string `yaml:"hosts"`
-		Port           int      `yaml:"port"`
-		Keyspace       string   `yaml:"keyspace"`
-		Table          string   `yaml:"table"`
-		LocalDC        string   `yaml:"local_dc"`
-		QueryTimeout   int      `yaml:"query_timeout_ms"`
-		ConnectTimeout int      `yaml:"connect_timeout_ms"`
-		TLS            struct {
-			CaPath   string `yaml:"ca"`
-			CertPath string `yaml:"cert"`
-			KeyPath  string `yaml:"key"`
-		}
-		Authentication struct {
-			Username string `yaml:"username"`
-			Password string `yaml:"password"`
+// MigrationTable is the (old) table from which the values of a namespace are being migrated.
+type MigrationTable struct {
+	Keyspace string `yaml:"keyspace"`
+	Table    string `yaml:"table"`
+}
+
+// HTTPServerConfig represents the timeouts (in milliseconds) and limits of the HTTP server; Zero disables any of them.
+type HTTPServerConfig struct {
+	ReadTimeout       Milliseconds `yaml:"read_timeout_ms"`
+	ReadHeaderTimeout Milliseconds `yaml:"read_header_timeout_ms"`
+	WriteTimeout      Milliseconds `yaml:"write_timeout_ms"`
+	IdleTimeout       Milliseconds `yaml:"idle_timeout_ms"`
+	MaxHeaderBytes    int          `yaml:"max_header_bytes"`
+	MaxConnections    int          `yaml:"max_connections"`
+	// H2C enables cleartext HTTP/2 (with prior knowledge) on listeners without TLS.
+	H2C bool `yaml:"h2c"`
+}
+
+// Seconds is a duration in (whole) seconds; It is configured either as an integer, or as a duration string
+// (see parseDuration), i.e. 90s, 12h, or 1d.
+type Seconds int
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (s *Seconds) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	n, err := unmarshalDuration(unmarshal, time.Second)
+	*s = Seconds(n)
+	return err
+}
+
+// Milliseconds is a duration in (whole) milliseconds; It is configured either as an integer, or as a duration
+// string (see parseDuration), i.e. 500ms, or 12s.
+type Milliseconds int
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (ms *Milliseconds) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	n, err := unmarshalDuration(unmarshal, time.Millisecond)
+	*ms = Milliseconds(n)
+	return err
+}
+
+// unmarshalDuration decodes an integer (a number of units), or a duration string, and returns the number of
+// units.  Durations that are not a whole number of units are an error.
+func unmarshalDuration(unmarshal func(interface{}) error, unit time.Duration) (int, error) {
+	var n int
+	if err := unmarshal(&n); err == nil {
+		return n, nil
+	}
+
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return 0, err
+	}
+
+	d, err := parseDuration(str)
+	if err != nil {
+		return 0, err
+	}
+	if d%unit != 0 {
+		return 0, fmt.Errorf("Invalid duration %q (must be a whole number of %s)", str, strings.TrimPrefix(unit.String(), "1"))
+	}
+	return int(d / unit), nil
+}
+
+// parseDuration parses a duration string as time.ParseDuration does (i.e. 1h30m, or 500ms), and additionally
+// a whole number of days (i.e. 1d).
+func parseDuration(str string) (time.Duration, error) {
+	if days, err := strconv.Atoi(strings.TrimSuffix(str, "d")); err == nil && strings.HasSuffix(str, "d") {
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid duration %q (must be an integer, or a duration such as 12s or 1d)", str)
+	}
+	return d, nil
+}
+
+// Namespace represents a distinct space of keys, served from its own base URI and stored in its own table.
+type Namespace struct {
+	Name         string  `yaml:"name"`
+	BaseURI      string  `yaml:"base_uri"`
+	Keyspace     string  `yaml:"keyspace"`
+	Table        string  `yaml:"table"`
+	DefaultTTL   Seconds `yaml:"default_ttl"`
+	MaxKeySize   int     `yaml:"max_key_size"`
+	MaxValueSize int     `yaml:"max_value_size"`
+	// TouchOnRead enables sliding expiration; Values read with less than TouchThreshold seconds
+	// of remaining lifetime are re-written with the default TTL.
+	TouchOnRead    bool    `yaml:"touch_on_read"`
+	TouchThreshold Seconds `yaml:"touch_threshold"`
+	// Checksums enables the storage (and verification) of value checksums; Requires a `checksum blob` column.
+	Checksums bool `yaml:"checksums"`
+	// Compression of stored values; Values of at least MinSize bytes are compressed with Algorithm.
+	Compression struct {
+		Algorithm string `yaml:"algorithm"`
+		MinSize   int    `yaml:"min_size"`
+	}
+	Consistency struct {
+		Read   string `yaml:"read"`
+		Write  string `yaml:"write"`
+		Delete string `yaml:"delete"`
+	}
+}
+
+// AuthorizationRule grants an (authenticated) identity, qualified by its source (i.e. token:mediawiki, see
+// identitySources), access to keys beginning with any of the prefixes, using any of the HTTP methods.  Rules apply to all namespaces, unless restricted to some.
+type AuthorizationRule struct {
+	Identity   string   `yaml:"identity"`
+	Namespaces []string `yaml:"namespaces"`
+	Prefixes   []string `yaml:"prefixes"`
+	Methods    []string `yaml:"methods"`
+}
+
+// Permits returns true if the rule grants identity access to key, using method.
+func (rule *AuthorizationRule) Permits(identity, method, key string) bool {
+	if identity == "" || identity != rule.Identity {
+		return false
+	}
+	if !contains(rule.Methods, method) {
+		return false
+	}
+	for _, prefix := range rule.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
 		}
 	}
+	return false
+}
+
+// AppliesTo returns true if the rule applies to the named namespace.
+func (rule *AuthorizationRule) AppliesTo(namespace string) bool {
+	return len(rule.Namespaces) == 0 || contains(rule.Namespaces, namespace)
+}
+
+// UnmarshalYAML populates a Namespace with sane defaults before unmarshalling.
+func (ns *Namespace) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type namespace Namespace
+	value := namespace(newNamespace())
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	*ns = Namespace(value)
+	return nil
+}
+
+// newNamespace returns a Namespace with default TTL and consistency levels assigned.
+func newNamespace() Namespace {
+	ns := Namespace{DefaultTTL: 86400}
+	ns.Consistency.Read = "local_quorum"
+	ns.Consistency.Write = "local_quorum"
+	ns.Consistency.Delete = "each_quorum"
+	return ns
 }
 
-// ReadConfig returns a new Config from a YAML file.
+// ReadConfig returns a new Config from a YAML file, and any overrides in the environment (see applyEnvironment).
 func ReadConfig(filename string) (*Config, error) {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	return NewConfig(data)
+	return parseConfig(data, os.Environ())
 }
 
 // NewConfig returns a new Config from YAML serialized as bytes.
 func NewConfig(data []byte) (*Config, error) {
+	return parseConfig(data, nil)
+}
+
+// parseConfig returns a new Config from YAML serialized as bytes, overridden by environment variables (in the
+// "key=value" form of os.Environ).
+func parseConfig(data []byte, environ []string) (*Config, error) {
 	// Populate a new Config with sane defaults
 	config := Config{
 		ServiceName: "kask",
@@ -86,14 +326,221 @@ func NewConfig(data []byte) (*Config, error) {
 	config.Cassandra.Table = "values"
 	config.Cassandra.QueryTimeout = 12000
 	config.Cassandra.ConnectTimeout = 5000
+	config.TLS.ReloadInterval = 60
+	config.TLS.HTTP2 = true
+	config.Admin.Address = "localhost"
+	config.Socket.Mode = "0660"
+	config.HTTPServer.ReadTimeout = 30000
+	config.HTTPServer.ReadHeaderTimeout = 10000
+	config.HTTPServer.WriteTimeout = 30000
+	config.HTTPServer.IdleTimeout = 120000
+	config.HTTPServer.MaxHeaderBytes = 1 << 20
+	config.HTTPCompression.MinSize = 1024
+	config.Shutdown.DrainPeriod = 5
+	config.Shutdown.Timeout = 30
+	config.Healthz.Timeout = 1000
+	config.Healthz.CacheTTL = 1000
 
-	err := yaml.Unmarshal(data, &config)
-	if err != nil {
+	// Decode strictly; Unknown (i.e. misspelled) keys are an error, rather than silently ignored.
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, errors.New(unknownFieldRegex.ReplaceAllString(err.Error(), "unknown key $1"))
+	}
+	if err := applyEnvironment(&config, environ); err != nil {
 		return nil, err
 	}
 	return validate(&config)
 }
 
+// unknownFieldRegex matches the (verbose) errors of yaml.UnmarshalStrict for unknown keys, i.e. "line 3: field
+// hsots not found in type struct { Hosts []string ... }".
+var unknownFieldRegex = regexp.MustCompile(`field (\S+) not found in type .*`)
+
+// envPrefix is the prefix of environment variables that override configuration; Not KASK_, which Kubernetes uses
+// for the variables of services named kask (i.e. KASK_PORT), or kask-cassandra (KASK_CASSANDRA_PORT), and so on.
+const envPrefix = "KASK_CONFIG_"
+
+// applyEnvironment overrides configuration with the values of environment variables.  Each field is named by the
+// path of its YAML keys, upper-cased, joined by underscores, and prefixed with KASK_CONFIG_ (i.e. cassandra.hosts
+// is KASK_CONFIG_CASSANDRA_HOSTS).  String values are taken literally, lists of strings are comma-separated, and values
+// of any other type are parsed as YAML (i.e. KASK_CONFIG_NAMESPACES='[{name: sessions, ...}]').  Variables that
+// name no field are ignored.
+func applyEnvironment(config *Config, environ []string) error {
+	vars := make(map[string]string)
+	for _, kv := range environ {
+		if i := strings.Index(kv, "="); i > 0 && strings.HasPrefix(kv, envPrefix) {
+			vars[kv[:i]] = kv[i+1:]
+		}
+	}
+	if len(vars) == 0 {
+		return nil
+	}
+	return overrideFields(reflect.ValueOf(config).Elem(), envPrefix, vars)
+}
+
+// overrideFields assigns the fields of a struct from the environment variables named for them.
+func overrideFields(v reflect.Value, prefix string, vars map[string]string) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := prefix + strings.ToUpper(yamlKey(field))
+
+		if field.Type.Kind() == reflect.Struct {
+			if err := overrideFields(v.Field(i), name+"_", vars); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := vars[name]
+		if !ok {
+			continue
+		}
+
+		if err := setField(v.Field(i), value); err != nil {
+			return fmt.Errorf("Invalid value of %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// setField assigns a field from the (string) value of an environment variable.
+func setField(v reflect.Value, value string) error {
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(value)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		var list []string
+		for _, elem := range strings.Split(value, ",") {
+			if elem = strings.TrimSpace(elem); elem != "" {
+				list = append(list, elem)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		ptr := reflect.New(v.Type())
+		if err := yaml.Unmarshal([]byte(value), ptr.Interface()); err != nil {
+			return err
+		}
+		v.Set(ptr.Elem())
+	}
+	return nil
+}
+
+// yamlKey returns the YAML key of a struct field.
+func yamlKey(field reflect.StructField) string {
+	if key := strings.Split(field.Tag.Get("yaml"), ",")[0]; key != "" {
+		return key
+	}
+	return strings.ToLower(field.Name)
+}
+
+// Redacted returns a copy of the Config with the values of secrets (fields tagged `secret:"true"`) replaced.
+func (config *Config) Redacted() *Config {
+	redacted := *config
+	redact(reflect.ValueOf(&redacted).Elem())
+	return &redacted
+}
+
+// redact replaces the (non-empty) secrets of a struct, and of the structs it contains.
+func redact(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		switch {
+		case field.Type.Kind() == reflect.Struct:
+			redact(v.Field(i))
+		case field.Tag.Get("secret") == "true" && v.Field(i).Kind() == reflect.String && v.Field(i).String() != "":
+			v.Field(i).SetString("REDACTED")
+		}
+	}
+}
+
+// ConfigChange is a setting that differs between two Configs; Values are formatted as strings (with secrets
+// redacted).
+type ConfigChange struct {
+	Path string `json:"path"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// reloadable are the (paths of) settings that can be changed without a restart; All others require one.
+var reloadable = map[string]bool{
+	"log_level":                    true,
+	"default_ttl":                  true,
+	"namespaces[].default_ttl":     true,
+	"namespaces[].max_key_size":    true,
+	"namespaces[].max_value_size":  true,
+	"namespaces[].touch_on_read":   true,
+	"namespaces[].touch_threshold": true,
+}
+
+// listIndex matches the index of a list element in the path of a setting (i.e. namespaces[0].table).
+var listIndex = regexp.MustCompile(`\[\d+\]`)
+
+// Reloadable returns true if the setting can be changed without a restart.
+func (change ConfigChange) Reloadable() bool {
+	return reloadable[listIndex.ReplaceAllString(change.Path, "[]")]
+}
+
+// DiffConfig returns the settings that differ between two Configs, ordered by path.
+func DiffConfig(from, to *Config) []ConfigChange {
+	before, after := make(map[string]interface{}), make(map[string]interface{})
+	flatten(reflect.ValueOf(from).Elem(), "", before)
+	flatten(reflect.ValueOf(to).Elem(), "", after)
+
+	redactedBefore, redactedAfter := make(map[string]interface{}), make(map[string]interface{})
+	flatten(reflect.ValueOf(from.Redacted()).Elem(), "", redactedBefore)
+	flatten(reflect.ValueOf(to.Redacted()).Elem(), "", redactedAfter)
+
+	paths := make(map[string]bool)
+	for path := range before {
+		paths[path] = true
+	}
+	for path := range after {
+		paths[path] = true
+	}
+
+	var changes []ConfigChange
+	for path := range paths {
+		was, ok1 := before[path]
+		is, ok2 := after[path]
+		if ok1 == ok2 && reflect.DeepEqual(was, is) {
+			continue
+		}
+		changes = append(changes, ConfigChange{path, formatSetting(redactedBefore, path), formatSetting(redactedAfter, path)})
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+// flatten adds the settings of a struct (and of the structs, and lists of structs, it contains) to a map of
+// (YAML) path to value.
+func flatten(v reflect.Value, prefix string, settings map[string]interface{}) {
+	for i := 0; i < v.NumField(); i++ {
+		path := prefix + yamlKey(v.Type().Field(i))
+		field := v.Field(i)
+
+		switch {
+		case field.Kind() == reflect.Struct:
+			flatten(field, path+".", settings)
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct:
+			for j := 0; j < field.Len(); j++ {
+				flatten(field.Index(j), fmt.Sprintf("%s[%d].", path, j), settings)
+			}
+		default:
+			settings[path] = field.Interface()
+		}
+	}
+}
+
+// formatSetting returns the value of a (flattened) setting as a string.
+func formatSetting(settings map[string]interface{}, path string) string {
+	value, ok := settings[path]
+	if !ok {
+		return "<unset>"
+	}
+	return fmt.Sprint(value)
+}
+
 func validate(config *Config) (*Config, error) {
 	if !strings.HasSuffix(config.BaseURI, "/") {
 		config.BaseURI += "/"
@@ -104,6 +551,45 @@ func validate(config *Config) (*Config, error) {
 	if config.DefaultTTL < 0 {
 		return nil, errors.New("TTL must be a positive integer")
 	}
+	if config.HTTPCompression.MinSize < 0 {
+		return nil, errors.New("HTTP compression min_size must be a positive integer")
+	}
+	if config.Shutdown.DrainPeriod < 0 || config.Shutdown.Timeout < 0 {
+		return nil, errors.New("Shutdown drain_period and timeout must be positive integers")
+	}
+	if config.Healthz.Timeout <= 0 || config.Healthz.CacheTTL < 0 {
+		return nil, errors.New("Healthz timeout_ms must be greater than zero, and cache_ms a positive integer")
+	}
+
+	// Validate listen ports
+	if err := validatePorts(config); err != nil {
+		return nil, err
+	}
+
+	// Validate Cassandra connection settings
+	if err := validateCassandra(config); err != nil {
+		return nil, err
+	}
+
+	// Validate namespaces
+	if err := validateNamespaces(config); err != nil {
+		return nil, err
+	}
+
+	// Validate admin listener settings
+	if err := validateAdmin(config); err != nil {
+		return nil, err
+	}
+
+	// Validate Unix domain socket listener settings
+	if err := validateSocket(config); err != nil {
+		return nil, err
+	}
+
+	// Validate HTTP server timeouts and limits
+	if err := validateHTTPServer(config); err != nil {
+		return nil, err
+	}
 
 	// Validate log level
 	if err := validateLogLevel(config); err != nil {
@@ -115,13 +601,28 @@ func validate(config *Config) (*Config, error) {
 		return nil, err
 	}
 
+	// Validate Kask client authentication settings
+	if err := validateAuthentication(config); err != nil {
+		return nil, err
+	}
+
+	// Validate Kask authorization settings
+	if err := validateAuthorization(config); err != nil {
+		return nil, err
+	}
+
 	// Validate Cassandra client authentication settings
-	if err := validateCassandraAuthentication(config); err != nil {
+	if err := validateCassandraAuthentication("Cassandra", &config.Cassandra); err != nil {
 		return nil, err
 	}
 
 	// Validate Cassandra client TLS settings
-	if err := validateCassandraTLS(config); err != nil {
+	if err := validateCassandraTLS("Cassandra", &config.Cassandra); err != nil {
+		return nil, err
+	}
+
+	// Validate migration settings
+	if err := validateMigration(config); err != nil {
 		return nil, err
 	}
 
@@ -138,39 +639,485 @@ func validateLogLevel(config *Config) error {
 	return fmt.Errorf("Unsupported log level: %s", config.LogLevel)
 }
 
+var namespaceNameRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// cqlIdentifierRegex matches valid (unquoted) Cassandra keyspace and table names.
+var cqlIdentifierRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,47}$`)
+
+// validatePorts ensures that listen ports are within range.
+func validatePorts(config *Config) error {
+	if config.Port < 0 || config.Port > 65535 {
+		return fmt.Errorf("Invalid listen_port: %d (must be 0-65535)", config.Port)
+	}
+	if config.Admin.Port > 65535 {
+		return fmt.Errorf("Invalid admin listen_port: %d (must be 0-65535)", config.Admin.Port)
+	}
+	return nil
+}
+
+// validateCassandra ensures properly constructed Cassandra connection settings.
+func validateCassandra(config *Config) error {
+	cassandra := config.Cassandra
+
+	if len(cassandra.Hosts) == 0 {
+		return errors.New("At least one Cassandra host is required")
+	}
+	for _, host := range cassandra.Hosts {
+		if strings.TrimSpace(host) == "" {
+			return errors.New("Cassandra hosts must not be empty")
+		}
+	}
+	if cassandra.Port < 1 || cassandra.Port > 65535 {
+		return fmt.Errorf("Invalid Cassandra port: %d (must be 1-65535)", cassandra.Port)
+	}
+	if !cqlIdentifierRegex.MatchString(cassandra.Keyspace) {
+		return fmt.Errorf("Invalid Cassandra keyspace: %q", cassandra.Keyspace)
+	}
+	if !cqlIdentifierRegex.MatchString(cassandra.Table) {
+		return fmt.Errorf("Invalid Cassandra table: %q", cassandra.Table)
+	}
+	if cassandra.QueryTimeout <= 0 || cassandra.ConnectTimeout <= 0 {
+		return errors.New("Cassandra query_timeout_ms and connect_timeout_ms must be greater than zero")
+	}
+	return nil
+}
+
+// validateNamespaces ensures a properly constructed set of namespaces.  If none are configured, a single
+// namespace named "default" is created from the top-level base URI, default TTL, and Cassandra keyspace/table.
+func validateNamespaces(config *Config) error {
+	if len(config.Namespaces) == 0 {
+		ns := newNamespace()
+		ns.Name = "default"
+		ns.BaseURI = config.BaseURI
+		ns.Table = config.Cassandra.Table
+		ns.DefaultTTL = config.DefaultTTL
+		config.Namespaces = []Namespace{ns}
+	}
+
+	names := make(map[string]bool)
+
+	for i := range config.Namespaces {
+		ns := &config.Namespaces[i]
+
+		if !namespaceNameRegex.MatchString(ns.Name) {
+			return fmt.Errorf("Invalid namespace name: %q", ns.Name)
+		}
+		if names[ns.Name] {
+			return fmt.Errorf("Duplicate namespace name: %s", ns.Name)
+		}
+		names[ns.Name] = true
+
+		if ns.BaseURI == "" {
+			return fmt.Errorf("Namespace %s: base_uri is required", ns.Name)
+		}
+		if !strings.HasSuffix(ns.BaseURI, "/") {
+			ns.BaseURI += "/"
+		}
+		if !strings.HasPrefix(ns.BaseURI, "/") {
+			ns.BaseURI = "/" + ns.BaseURI
+		}
+		if ns.Keyspace == "" {
+			ns.Keyspace = config.Cassandra.Keyspace
+		}
+		if ns.Table == "" {
+			return fmt.Errorf("Namespace %s: table is required", ns.Name)
+		}
+		if !cqlIdentifierRegex.MatchString(ns.Keyspace) {
+			return fmt.Errorf("Namespace %s: invalid keyspace %q", ns.Name, ns.Keyspace)
+		}
+		if !cqlIdentifierRegex.MatchString(ns.Table) {
+			return fmt.Errorf("Namespace %s: invalid table %q", ns.Name, ns.Table)
+		}
+		if ns.DefaultTTL < 0 {
+			return fmt.Errorf("Namespace %s: TTL must be a positive integer", ns.Name)
+		}
+		if ns.MaxKeySize < 0 || ns.MaxValueSize < 0 {
+			return fmt.Errorf("Namespace %s: size limits must be positive integers", ns.Name)
+		}
+		if err := validateTouchOnRead(ns); err != nil {
+			return err
+		}
+		switch ns.Compression.Algorithm {
+		case "", "zstd":
+		default:
+			return fmt.Errorf("Namespace %s: unsupported compression algorithm %s (must be zstd)", ns.Name, ns.Compression.Algorithm)
+		}
+		if ns.Compression.MinSize < 0 {
+			return fmt.Errorf("Namespace %s: compression min_size must be a positive integer", ns.Name)
+		}
+		for _, level := range []string{ns.Consistency.Read, ns.Consistency.Write, ns.Consistency.Delete} {
+			if _, err := gocql.ParseConsistencyWrapper(level); err != nil {
+				return fmt.Errorf("Namespace %s: %s", ns.Name, err)
+			}
+		}
+	}
+
+	// Base URIs must not overlap; A request must unambiguously belong to one namespace.
+	for i, a := range config.Namespaces {
+		for _, b := range config.Namespaces[i+1:] {
+			if strings.HasPrefix(a.BaseURI, b.BaseURI) || strings.HasPrefix(b.BaseURI, a.BaseURI) {
+				return fmt.Errorf("Namespaces %s and %s have overlapping base URIs (%s, %s)", a.Name, b.Name, a.BaseURI, b.BaseURI)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateTouchOnRead ensures a properly constructed sliding expiration config; The touch threshold defaults
+// to half the default TTL, and cannot exceed it.
+func validateTouchOnRead(ns *Namespace) error {
+	if ns.TouchThreshold < 0 {
+		return fmt.Errorf("Namespace %s: touch threshold must be a positive integer", ns.Name)
+	}
+	if !ns.TouchOnRead {
+		return nil
+	}
+	if ns.DefaultTTL == 0 {
+		return fmt.Errorf("Namespace %s: touch on read requires a (non-zero) default TTL", ns.Name)
+	}
+	if ns.TouchThreshold == 0 {
+		ns.TouchThreshold = ns.DefaultTTL / 2
+	}
+	if ns.TouchThreshold > ns.DefaultTTL {
+		return fmt.Errorf("Namespace %s: touch threshold cannot exceed the default TTL", ns.Name)
+	}
+	return nil
+}
+
+// adminPaths are the URIs of operational endpoints.
+var adminPaths = []string{"/metrics", "/healthz", "/healthz/live", "/healthz/ready", "/openapi"}
+
+// validateAdmin ensures a properly constructed admin listener config.  Without an admin listener, operational
+// endpoints share the data listener, and namespace base URIs must not collide with them (i.e. be equal to, or
+// beneath, one of them).  A base URI above them (i.e. /) is permitted; The more specific paths are routed to the
+// operational endpoints, so that the keys named for them (metrics, healthz, and openapi) cannot be used.
+func validateAdmin(config *Config) error {
+	admin := config.Admin
+
+	if admin.Port == 0 {
+		if admin.TLS {
+			return errors.New("Admin TLS requires that an admin listen_port be configured")
+		}
+		for _, ns := range config.Namespaces {
+			for _, p := range adminPaths {
+				if strings.HasPrefix(ns.BaseURI, p+"/") {
+					return fmt.Errorf("Namespace %s: base URI %s collides with %s (configure an admin listener, or another base URI)", ns.Name, ns.BaseURI, p)
+				}
+			}
+		}
+		return nil
+	}
+
+	if admin.Port < 0 {
+		return errors.New("Admin listen_port must be a positive integer")
+	}
+	if admin.Port == config.Port && (admin.Address == config.Address || admin.Address == "" || config.Address == "") {
+		return errors.New("Admin listener must not share the address and port of the data listener")
+	}
+	if admin.TLS && config.TLS.CertPath == "" {
+		return errors.New("Admin TLS requires that Kask cert/key be configured")
+	}
+	return nil
+}
+
+// validateSocket ensures a properly constructed Unix domain socket listener config.
+func validateSocket(config *Config) error {
+	if _, err := strconv.ParseUint(config.Socket.Mode, 8, 32); err != nil {
+		return fmt.Errorf("Invalid listen_socket mode: %s (must be octal, i.e. 0660)", config.Socket.Mode)
+	}
+	if config.Port == 0 && config.Socket.Path == "" {
+		return errors.New("listen_port may be 0 (disabling the TCP listener) only if a listen_socket is configured")
+	}
+	// Clients of the socket present no certificates, so it would bypass their verification (and allow-lists).
+	if config.Socket.Path != "" && config.TLS.ClientCAPath != "" {
+		return errors.New("listen_socket cannot be combined with client certificate verification (tls.client_ca)")
+	}
+	if config.HTTPServer.H2C && config.TLS.CertPath != "" && config.Socket.Path == "" {
+		return errors.New("h2c requires a cleartext listener (TLS disabled, or a listen_socket)")
+	}
+	return nil
+}
+
+// validateHTTPServer ensures properly constructed HTTP server timeouts and limits.
+func validateHTTPServer(config *Config) error {
+	server := config.HTTPServer
+	for _, v := range []Milliseconds{server.ReadTimeout, server.ReadHeaderTimeout, server.WriteTimeout, server.IdleTimeout} {
+		if v < 0 {
+			return errors.New("HTTP server timeouts must be positive integers")
+		}
+	}
+	if server.MaxHeaderBytes < 0 || server.MaxConnections < 0 {
+		return errors.New("HTTP server limits must be positive integers")
+	}
+	return nil
+}
+
 // validateKaskTLS ensures a properly constructed TLS configuration.
 func validateKaskTLS(config *Config) error {
 	// Either CertPath and KeyPath are both zero (TLS not enabled), or both must be assigned.
 	if !mutuallyInclusive(config.TLS.CertPath, config.TLS.KeyPath) {
 		return errors.New("Kask cert/key values are mutually inclusive")
 	}
+	// Client certificates can only be verified if TLS is enabled.
+	if config.TLS.ClientCAPath != "" && config.TLS.CertPath == "" {
+		return errors.New("Kask cert/key must be configured if a client CA is")
+	}
+	if config.TLS.ReloadInterval < 0 {
+		return errors.New("Kask TLS reload_interval must be a positive integer")
+	}
+	if err := validateTLSParameters(config); err != nil {
+		return err
+	}
+	switch config.TLS.ClientAuth {
+	case "", "required", "optional":
+	default:
+		return fmt.Errorf("Unsupported client_auth value: %s (must be one of required or optional)", config.TLS.ClientAuth)
+	}
+	// Allow-lists are meaningless without verified client certificates.
+	allowed := config.TLS.AllowedClients
+	if config.TLS.ClientCAPath == "" && (len(allowed.Read) > 0 || len(allowed.Write) > 0 || len(allowed.Delete) > 0) {
+		return errors.New("a Kask client CA must be configured if allowed clients are")
+	}
 	return nil
 }
 
-// validateCassandraAuthentication ensures a properly constructed Cassandra client authentication config.
-func validateCassandraAuthentication(config *Config) error {
-	auth := config.Cassandra.Authentication
+// validateTLSParameters ensures valid (and consistent) TLS protocol versions, cipher suites, and curves.
+func validateTLSParameters(config *Config) error {
+	settings := config.TLS
+
+	for _, version := range []string{settings.MinVersion, settings.MaxVersion} {
+		if _, ok := tlsVersions[version]; version != "" && !ok {
+			return fmt.Errorf("Unsupported TLS version: %s (must be one of 1.0, 1.1, 1.2, or 1.3)", version)
+		}
+	}
+	if settings.MinVersion != "" && settings.MaxVersion != "" && tlsVersions[settings.MinVersion] > tlsVersions[settings.MaxVersion] {
+		return fmt.Errorf("TLS min_version (%s) cannot exceed max_version (%s)", settings.MinVersion, settings.MaxVersion)
+	}
+
+	for _, name := range settings.CipherSuites {
+		if _, ok := cipherSuiteID(name); !ok {
+			return fmt.Errorf("Unsupported (or insecure) TLS cipher suite: %s", name)
+		}
+	}
+	// The cipher suites of TLS 1.3 are not configurable.
+	if len(settings.CipherSuites) > 0 && settings.MinVersion == "1.3" {
+		return errors.New("TLS cipher_suites cannot be configured when min_version is 1.3")
+	}
+
+	for _, name := range settings.Curves {
+		if _, ok := tlsCurves[name]; !ok {
+			return fmt.Errorf("Unsupported TLS curve: %s (must be one of X25519, P-256, P-384, or P-521)", name)
+		}
+	}
+
+	return nil
+}
+
+// minHMACSecretLength is the minimum length of secrets used to sign authentication tokens.
+const minHMACSecretLength = 32
+
+// validateAuthentication ensures a properly constructed Kask client authentication config.
+func validateAuthentication(config *Config) error {
+	auth := config.Authentication
+	// The secret may be configured inline, or read from a file, but not both.
+	if auth.HMACSecret != "" && auth.HMACSecretFile != "" {
+		return errors.New("HMAC secret and secret file are mutually exclusive")
+	}
+	// (The length of secrets read from a file is verified when they are read.)
+	if secret := auth.HMACSecret; secret != "" && len(secret) < minHMACSecretLength {
+		return fmt.Errorf("HMAC secret must be at least %d characters", minHMACSecretLength)
+	}
+	return nil
+}
+
+// validateAuthorization ensures properly constructed authorization rules.
+func validateAuthorization(config *Config) error {
+	if len(config.Authorization) == 0 {
+		return nil
+	}
+
+	// Without some means of authentication, no client would have an identity (and all requests would be forbidden).
+	auth := config.Authentication
+	if auth.TokensFile == "" && auth.HMACSecret == "" && auth.HMACSecretFile == "" && config.TLS.ClientCAPath == "" {
+		return errors.New("authorization rules require that authentication (tokens, HMAC, or client certificates) be configured")
+	}
+
+	for i := range config.Authorization {
+		rule := &config.Authorization[i]
+
+		if rule.Identity == "" {
+			return fmt.Errorf("Authorization rule %d: identity is required", i+1)
+		}
+		if j := strings.Index(rule.Identity, ":"); j < 1 || j == len(rule.Identity)-1 || !contains(identitySources, rule.Identity[:j]) {
+			return fmt.Errorf("Authorization rule %d: identity %q must be qualified by its source (one of %s, i.e. token:%s)", i+1, rule.Identity, strings.Join(identitySources, ", "), rule.Identity)
+		}
+		if len(rule.Prefixes) == 0 {
+			return fmt.Errorf("Authorization rule %d: at least one prefix is required (an empty prefix matches every key)", i+1)
+		}
+		if len(rule.Methods) == 0 {
+			return fmt.Errorf("Authorization rule %d: at least one method is required", i+1)
+		}
+		for j, method := range rule.Methods {
+			rule.Methods[j] = strings.ToUpper(method)
+			switch rule.Methods[j] {
+			case "GET", "HEAD", "POST", "PUT", "DELETE":
+			default:
+				return fmt.Errorf("Authorization rule %d: unsupported method %s", i+1, method)
+			}
+		}
+		for _, name := range rule.Namespaces {
+			if !hasNamespace(config, name) {
+				return fmt.Errorf("Authorization rule %d: no such namespace %s", i+1, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// hasNamespace returns true if a namespace by that name is configured.
+func hasNamespace(config *Config, name string) bool {
+	for _, ns := range config.Namespaces {
+		if ns.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCassandraAuthentication ensures a properly constructed Cassandra client authentication config (of the
+// cluster named in errors).
+func validateCassandraAuthentication(name string, cassandra *CassandraConfig) error {
+	auth := cassandra.Authentication
+	// The password may be configured inline, or read from a file, but not both.
+	if auth.Password != "" && auth.PasswordFile != "" {
+		return fmt.Errorf("%s password and password_file values are mutually exclusive", name)
+	}
 	// Either username and password are both zero (authentication not enabled), or both must be assigned.
-	if !mutuallyInclusive(auth.Username, auth.Password) {
-		return errors.New("Cassandra username/password values are mutually inclusive")
+	if !mutuallyInclusive(auth.Username, auth.Password+auth.PasswordFile) {
+		return fmt.Errorf("%s username/password values are mutually inclusive", name)
 	}
 	return nil
 }
 
-// validateCassandraTLS ensures a properly constructed Cassandra client TLS configuration.
-func validateCassandraTLS(config *Config) error {
-	tls := config.Cassandra.TLS
+// readSecretFile returns the contents of a file containing a secret (i.e. a password), less any trailing newline.
+func readSecretFile(filename string) (string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimRight(string(data), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("secret file %s is empty", filename)
+	}
+	return secret, nil
+}
+
+// validateMigration ensures a properly constructed migration config; The old backend must differ from the new,
+// either by cluster, or by table.  Unset settings of the old cluster default to those of the new one.
+func validateMigration(config *Config) error {
+	migration := &config.Migration
+	if !migration.Enabled {
+		return nil
+	}
+
+	old := &migration.Cassandra
+	if len(old.Hosts) == 0 && len(migration.Tables) == 0 {
+		return errors.New("Migration requires an old cluster (migration.cassandra.hosts), or old tables (migration.tables)")
+	}
+	for _, host := range old.Hosts {
+		if strings.TrimSpace(host) == "" {
+			return errors.New("Migration Cassandra hosts must not be empty")
+		}
+	}
+	if old.Port == 0 {
+		old.Port = config.Cassandra.Port
+	}
+	if old.Port < 1 || old.Port > 65535 {
+		return fmt.Errorf("Invalid migration Cassandra port: %d (must be 1-65535)", old.Port)
+	}
+	if old.QueryTimeout == 0 {
+		old.QueryTimeout = config.Cassandra.QueryTimeout
+	}
+	if old.ConnectTimeout == 0 {
+		old.ConnectTimeout = config.Cassandra.ConnectTimeout
+	}
+	if err := validateCassandraAuthentication("Migration Cassandra", old); err != nil {
+		return err
+	}
+	if err := validateCassandraTLS("Migration Cassandra", old); err != nil {
+		return err
+	}
+
+	for name, table := range migration.Tables {
+		if !hasNamespace(config, name) {
+			return fmt.Errorf("Migration tables: no such namespace %s", name)
+		}
+		for _, identifier := range []string{table.Keyspace, table.Table} {
+			if identifier != "" && !cqlIdentifierRegex.MatchString(identifier) {
+				return fmt.Errorf("Migration tables: invalid keyspace or table of namespace %s: %q", name, identifier)
+			}
+		}
+	}
+
+	return nil
+}
+
+// MigrationSource returns the old keyspace and table of a namespace, and true if it is being migrated (i.e. if
+// migration is enabled, and either the cluster or table differs).
+func (config *Config) MigrationSource(ns *Namespace) (string, string, bool) {
+	migration := config.Migration
+	if !migration.Enabled {
+		return "", "", false
+	}
+
+	table, ok := migration.Tables[ns.Name]
+	if !ok && len(migration.Cassandra.Hosts) == 0 {
+		return "", "", false
+	}
+
+	keyspace, name := ns.Keyspace, ns.Table
+	if table.Keyspace != "" {
+		keyspace = table.Keyspace
+	}
+	if table.Table != "" {
+		name = table.Table
+	}
+
+	// Migrating a table to itself (of the same cluster) would be a no-op.
+	if len(migration.Cassandra.Hosts) == 0 && keyspace == ns.Keyspace && name == ns.Table {
+		return "", "", false
+	}
+
+	return keyspace, name, true
+}
+
+// validateCassandraTLS ensures a properly constructed Cassandra client TLS configuration (of the cluster named in
+// errors).
+func validateCassandraTLS(name string, cassandra *CassandraConfig) error {
+	tls := cassandra.TLS
 	// If a ca is zero (unset), neither of cert/key can be.
 	if tls.CaPath == "" && (tls.CertPath != "" || tls.KeyPath != "") {
-		return errors.New("a Cassandra CA must be configured if key and cert are")
+		return fmt.Errorf("a %s CA must be configured if key and cert are", name)
 	}
 	// If ca is set, then either both cert and key are, or neither are.
 	if tls.CaPath != "" && !mutuallyInclusive(tls.CertPath, tls.KeyPath) {
-		return errors.New("Cassandra TLS key/cert values are mutually inclusive")
+		return fmt.Errorf("%s TLS key/cert values are mutually inclusive", name)
 	}
 	return nil
 }
 
+// contains returns true if value is an element of list.
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 // mutuallyInclusive returns true if its arguments are either both zero, or neither are.
 func mutuallyInclusive(a string, b string) bool {
 	if (a != "" && b == "") || (b != "" && a == "") {
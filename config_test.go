@@ -22,6 +22,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -63,15 +64,15 @@ cassandra:
 		AssertEquals(t, config.Port, 8888, "Port number")
 		AssertEquals(t, config.TLS.CertPath, "/path/to/cert", "Kask TLS cert path name")
 		AssertEquals(t, config.TLS.KeyPath, "/path/to/key", "Kask TLS key path name")
-		AssertEquals(t, config.DefaultTTL, 1, "TTL value")
+		AssertEquals(t, config.DefaultTTL, Seconds(1), "TTL value")
 		AssertEquals(t, config.LogLevel, "error", "Log level")
 		AssertEquals(t, config.OpenAPISpec, "", "OpenAPI specification file")
 		AssertEquals(t, len(config.Cassandra.Hosts), 3, "Number of Cassandra hostnames")
 		AssertEquals(t, config.Cassandra.Port, 9043, "Cassandra port number")
 		AssertEquals(t, config.Cassandra.Keyspace, "kittens", "Cassandra keyspace")
 		AssertEquals(t, config.Cassandra.Table, "data", "Cassandra table name")
-		AssertEquals(t, config.Cassandra.QueryTimeout, 1, "Cassandra query timeout")
-		AssertEquals(t, config.Cassandra.ConnectTimeout, 1, "Cassandra connect timeout")
+		AssertEquals(t, config.Cassandra.QueryTimeout, Milliseconds(1), "Cassandra query timeout")
+		AssertEquals(t, config.Cassandra.ConnectTimeout, Milliseconds(1), "Cassandra connect timeout")
 		AssertEquals(t, config.Cassandra.Authentication.Username, "myuser", "Cassandra username")
 		AssertEquals(t, config.Cassandra.Authentication.Password, "mypass", "Cassandra password")
 		AssertEquals(t, config.Cassandra.TLS.CaPath, "/path/to/ca", "Cassandra TLS CA path name")
@@ -89,26 +90,434 @@ func TestConfigDefaults(t *testing.T) {
 		AssertEquals(t, config.BaseURI, "/v1/", "URI prefix")
 		AssertEquals(t, config.Address, "localhost", "Bind address")
 		AssertEquals(t, config.Port, 8080, "Port number")
-		AssertEquals(t, config.DefaultTTL, 86400, "TTL value")
+		AssertEquals(t, config.DefaultTTL, Seconds(86400), "TTL value")
 		AssertEquals(t, config.LogLevel, "info", "Log level")
 		AssertEquals(t, len(config.Cassandra.Hosts), 1, "Number of Cassandra hostnames")
 		AssertEquals(t, config.Cassandra.Hosts[0], "localhost", "Number of Cassandra hostnames")
 		AssertEquals(t, config.Cassandra.Port, 9042, "Cassandra port number")
 		AssertEquals(t, config.Cassandra.Keyspace, "kask", "Cassandra keyspace")
 		AssertEquals(t, config.Cassandra.Table, "values", "Cassandra table name")
-		AssertEquals(t, config.Cassandra.QueryTimeout, 12000, "Cassandra query timeout")
-		AssertEquals(t, config.Cassandra.ConnectTimeout, 5000, "Cassandra connect timeout")
+		AssertEquals(t, config.Cassandra.QueryTimeout, Milliseconds(12000), "Cassandra query timeout")
+		AssertEquals(t, config.Cassandra.ConnectTimeout, Milliseconds(5000), "Cassandra connect timeout")
+		AssertEquals(t, len(config.Namespaces), 1, "Number of namespaces")
+		AssertEquals(t, config.Namespaces[0].Name, "default", "Namespace name")
+		AssertEquals(t, config.Namespaces[0].BaseURI, "/v1/", "Namespace URI prefix")
+		AssertEquals(t, config.Namespaces[0].Keyspace, "kask", "Namespace keyspace")
+		AssertEquals(t, config.Namespaces[0].Table, "values", "Namespace table")
+		AssertEquals(t, config.Namespaces[0].DefaultTTL, Seconds(86400), "Namespace TTL value")
+		AssertEquals(t, config.HTTPServer.ReadHeaderTimeout, Milliseconds(10000), "HTTP server read header timeout")
+		AssertEquals(t, config.HTTPServer.MaxHeaderBytes, 1<<20, "HTTP server max header bytes")
+		AssertEquals(t, config.HTTPServer.MaxConnections, 0, "HTTP server max connections")
+		AssertEquals(t, config.HTTPCompression.Enabled, false, "HTTP compression")
+		AssertEquals(t, config.HTTPCompression.MinSize, 1024, "HTTP compression minimum size")
+		AssertEquals(t, config.Shutdown.DrainPeriod, Seconds(5), "Shutdown drain period")
+		AssertEquals(t, config.Shutdown.Timeout, Seconds(30), "Shutdown timeout")
+		AssertEquals(t, config.Healthz.Timeout, Milliseconds(1000), "Healthz timeout")
+		AssertEquals(t, config.Healthz.CacheTTL, Milliseconds(1000), "Healthz cache TTL")
 	} else {
 		t.Errorf("Failed to initialize default configuration: %v", err)
 	}
 }
 
+func TestNamespaces(t *testing.T) {
+	var data = `
+cassandra:
+  keyspace: kask
+namespaces:
+  - name: sessions
+    base_uri: /sessions/v1
+    table: sessions
+    default_ttl: 3600
+    max_key_size: 256
+    max_value_size: 65536
+    consistency:
+      read: one
+      write: local_one
+  - name: echoseen
+    base_uri: /echoseen/v1/
+    keyspace: echo
+    table: seen
+`
+	config, err := NewConfig([]byte(data))
+	if err != nil {
+		t.Fatalf("Failed to read configuration data: %v", err)
+	}
+
+	AssertEquals(t, len(config.Namespaces), 2, "Number of namespaces")
+
+	sessions := config.Namespaces[0]
+	AssertEquals(t, sessions.Name, "sessions", "Namespace name")
+	AssertEquals(t, sessions.BaseURI, "/sessions/v1/", "Namespace URI prefix")
+	AssertEquals(t, sessions.Keyspace, "kask", "Namespace keyspace")
+	AssertEquals(t, sessions.Table, "sessions", "Namespace table")
+	AssertEquals(t, sessions.DefaultTTL, Seconds(3600), "Namespace TTL value")
+	AssertEquals(t, sessions.MaxKeySize, 256, "Namespace maximum key size")
+	AssertEquals(t, sessions.MaxValueSize, 65536, "Namespace maximum value size")
+	AssertEquals(t, sessions.Consistency.Read, "one", "Namespace read consistency")
+	AssertEquals(t, sessions.Consistency.Write, "local_one", "Namespace write consistency")
+	AssertEquals(t, sessions.Consistency.Delete, "each_quorum", "Namespace delete consistency")
+
+	echoseen := config.Namespaces[1]
+	AssertEquals(t, echoseen.BaseURI, "/echoseen/v1/", "Namespace URI prefix")
+	AssertEquals(t, echoseen.Keyspace, "echo", "Namespace keyspace")
+	AssertEquals(t, echoseen.DefaultTTL, Seconds(86400), "Namespace TTL value")
+	AssertEquals(t, echoseen.Consistency.Read, "local_quorum", "Namespace read consistency")
+	AssertEquals(t, echoseen.TouchOnRead, false, "Namespace touch on read")
+}
+
+func TestTouchThresholdDefault(t *testing.T) {
+	config, err := NewConfig([]byte("namespaces:\n  - name: a\n    base_uri: /a\n    table: a\n    default_ttl: 600\n    touch_on_read: true"))
+	if err != nil {
+		t.Fatalf("Failed to read configuration data: %v", err)
+	}
+	AssertEquals(t, config.Namespaces[0].TouchThreshold, Seconds(300), "Default touch threshold")
+}
+
+func TestNamespaceValidation(t *testing.T) {
+	testCases := []struct {
+		name string
+		data string
+	}{
+		{"Missing name", "namespaces:\n  - base_uri: /a\n    table: a"},
+		{"Invalid name", "namespaces:\n  - name: a/b\n    base_uri: /a\n    table: a"},
+		{"Missing base URI", "namespaces:\n  - name: a\n    table: a"},
+		{"Missing table", "namespaces:\n  - name: a\n    base_uri: /a"},
+		{"Negative TTL", "namespaces:\n  - name: a\n    base_uri: /a\n    table: a\n    default_ttl: -1"},
+		{"Negative size limit", "namespaces:\n  - name: a\n    base_uri: /a\n    table: a\n    max_value_size: -1"},
+		{"Invalid consistency", "namespaces:\n  - name: a\n    base_uri: /a\n    table: a\n    consistency:\n      read: most"},
+		{"Touch without TTL", "namespaces:\n  - name: a\n    base_uri: /a\n    table: a\n    default_ttl: 0\n    touch_on_read: true"},
+		{"Touch threshold exceeds TTL", "namespaces:\n  - name: a\n    base_uri: /a\n    table: a\n    default_ttl: 60\n    touch_on_read: true\n    touch_threshold: 61"},
+		{"Invalid compression", "namespaces:\n  - name: a\n    base_uri: /a\n    table: a\n    compression:\n      algorithm: lzma"},
+		{"Duplicate name", "namespaces:\n  - name: a\n    base_uri: /a\n    table: a\n  - name: a\n    base_uri: /b\n    table: b"},
+		{"Overlapping base URIs", "namespaces:\n  - name: a\n    base_uri: /a\n    table: a\n  - name: b\n    base_uri: /a/b\n    table: b"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewConfig([]byte(tc.data)); err == nil {
+				t.Errorf("%s expected to fail validation!", tc.name)
+			}
+		})
+	}
+}
+
+func TestEnvironmentOverrides(t *testing.T) {
+	data := []byte(`
+listen_port: 8081
+log_level: debug
+cassandra:
+  hosts: [cassandra1]
+  authentication:
+    username: kask
+    password: fromfile
+`)
+	environ := []string{
+		"KASK_CONFIG_LOG_LEVEL=warning",
+		"KASK_CONFIG_CASSANDRA_HOSTS=cassandra2, cassandra3",
+		"KASK_CONFIG_CASSANDRA_AUTHENTICATION_PASSWORD=from: env",
+		"KASK_CONFIG_HTTP_SERVER_MAX_CONNECTIONS=100",
+		"KASK_CONFIG_TLS_HTTP2=false",
+		"KASK_CONFIG_NAMESPACES=[{name: sessions, base_uri: /sessions/v1, table: sessions}]",
+		// Unrelated (i.e. Kubernetes service) variables are ignored
+		"KASK_PORT=tcp://10.0.0.1:8080",
+		"KASK_SERVICE_HOST=10.0.0.1",
+		"KASK_CASSANDRA_PORT=tcp://10.0.0.2:9042",
+		"KASK_LOG_LEVEL=emergency",
+		"KASK_CONFIG_SERVICE_HOST=10.0.0.3",
+		"PATH=/usr/bin",
+	}
+
+	config, err := parseConfig(data, environ)
+	if err != nil {
+		t.Fatalf("Unable to create Config instance: %s", err)
+	}
+
+	// Defaults < YAML < environment
+	AssertEquals(t, "kask", config.ServiceName, "Default not retained")
+	AssertEquals(t, 8081, config.Port, "YAML value not retained")
+	AssertEquals(t, 9042, config.Cassandra.Port, "Default not retained")
+	AssertEquals(t, "kask", config.Cassandra.Authentication.Username, "YAML value not retained")
+	AssertEquals(t, "warning", config.LogLevel, "YAML value not overridden")
+	AssertEquals(t, 2, len(config.Cassandra.Hosts), "Incorrect number of Cassandra hosts")
+	AssertEquals(t, "cassandra3", config.Cassandra.Hosts[1], "Incorrect Cassandra host")
+	AssertEquals(t, "from: env", config.Cassandra.Authentication.Password, "YAML value not overridden")
+	AssertEquals(t, 100, config.HTTPServer.MaxConnections, "Default not overridden")
+	AssertEquals(t, false, config.TLS.HTTP2, "Default not overridden")
+	AssertEquals(t, 1, len(config.Namespaces), "Incorrect number of namespaces")
+	AssertEquals(t, "sessions", config.Namespaces[0].Table, "Incorrect namespace table")
+	AssertEquals(t, Seconds(86400), config.Namespaces[0].DefaultTTL, "Namespace default not retained")
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, kv := range []string{"KASK_CONFIG_LISTEN_PORT=eighty", "KASK_CONFIG_LOG_LEVEL=emergency"} {
+			if _, err := parseConfig(data, []string{kv}); err == nil {
+				t.Errorf("Invalid environment override (%s) expected to fail!", kv)
+			}
+		}
+	})
+
+	t.Run("Not applied by NewConfig", func(t *testing.T) {
+		config, err := NewConfig(data)
+		if err != nil {
+			t.Fatalf("Unable to create Config instance: %s", err)
+		}
+		AssertEquals(t, "debug", config.LogLevel, "Incorrect log level")
+	})
+}
+
+func TestRedacted(t *testing.T) {
+	data := []byte(`
+authentication:
+  hmac_secret: 0123456789abcdef0123456789abcdef
+cassandra:
+  authentication:
+    username: kask
+    password: supersecret
+`)
+	config, err := NewConfig(data)
+	if err != nil {
+		t.Fatalf("Unable to create Config instance: %s", err)
+	}
+
+	redacted := config.Redacted()
+
+	AssertEquals(t, "REDACTED", redacted.Authentication.HMACSecret, "HMAC secret not redacted")
+	AssertEquals(t, "REDACTED", redacted.Cassandra.Authentication.Password, "Cassandra password not redacted")
+	AssertEquals(t, "kask", redacted.Cassandra.Authentication.Username, "Cassandra username redacted")
+	AssertEquals(t, "supersecret", config.Cassandra.Authentication.Password, "Original config modified")
+}
+
+func TestDiffConfig(t *testing.T) {
+	from, err := NewConfig([]byte("cassandra:\n  authentication:\n    username: kask\n    password: secret1"))
+	if err != nil {
+		t.Fatalf("Failed to read configuration data: %v", err)
+	}
+	to, err := NewConfig([]byte("log_level: debug\ncassandra:\n  authentication:\n    username: kask\n    password: secret2"))
+	if err != nil {
+		t.Fatalf("Failed to read configuration data: %v", err)
+	}
+
+	AssertEquals(t, 0, len(DiffConfig(from, from)), "Incorrect number of changes")
+
+	changes := DiffConfig(from, to)
+	AssertEquals(t, 2, len(changes), "Incorrect number of changes")
+	AssertEquals(t, ConfigChange{"cassandra.authentication.password", "REDACTED", "REDACTED"}, changes[0], "Incorrect change")
+	AssertEquals(t, false, changes[0].Reloadable(), "Cassandra password reloadable")
+	AssertEquals(t, ConfigChange{"log_level", "info", "debug"}, changes[1], "Incorrect change")
+	AssertEquals(t, true, changes[1].Reloadable(), "Log level not reloadable")
+
+	AssertEquals(t, true, ConfigChange{Path: "namespaces[2].default_ttl"}.Reloadable(), "Namespace TTL not reloadable")
+	AssertEquals(t, false, ConfigChange{Path: "namespaces[2].table"}.Reloadable(), "Namespace table reloadable")
+}
+
+func TestDurations(t *testing.T) {
+	config, err := NewConfig([]byte("default_ttl: 1d\ncassandra:\n  query_timeout_ms: 12s\n  connect_timeout_ms: 500ms\nnamespaces:\n  - name: sessions\n    base_uri: /sessions/v1\n    table: sessions\n    default_ttl: 1h30m\n    touch_on_read: true\n    touch_threshold: 600"))
+	if err != nil {
+		t.Fatalf("Failed to read configuration data: %v", err)
+	}
+
+	AssertEquals(t, Seconds(86400), config.DefaultTTL, "TTL value")
+	AssertEquals(t, Milliseconds(12000), config.Cassandra.QueryTimeout, "Cassandra query timeout")
+	AssertEquals(t, Milliseconds(500), config.Cassandra.ConnectTimeout, "Cassandra connect timeout")
+	AssertEquals(t, Seconds(5400), config.Namespaces[0].DefaultTTL, "Namespace TTL value")
+	AssertEquals(t, Seconds(600), config.Namespaces[0].TouchThreshold, "Touch threshold")
+
+	config, err = NewConfig([]byte("http_server:\n  read_timeout_ms: 30s\n  idle_timeout_ms: 2m\n  write_timeout_ms: 15000\nshutdown:\n  drain_period: 10s\n  timeout: 1m\nhealthz:\n  timeout_ms: 1s\n  cache_ms: 500\ntls:\n  reload_interval: 5m"))
+	if err != nil {
+		t.Fatalf("Failed to read configuration data: %v", err)
+	}
+
+	AssertEquals(t, Milliseconds(30000), config.HTTPServer.ReadTimeout, "HTTP server read timeout")
+	AssertEquals(t, Milliseconds(120000), config.HTTPServer.IdleTimeout, "HTTP server idle timeout")
+	AssertEquals(t, Milliseconds(15000), config.HTTPServer.WriteTimeout, "HTTP server write timeout")
+	AssertEquals(t, Seconds(10), config.Shutdown.DrainPeriod, "Shutdown drain period")
+	AssertEquals(t, Seconds(60), config.Shutdown.Timeout, "Shutdown timeout")
+	AssertEquals(t, Milliseconds(1000), config.Healthz.Timeout, "Healthz timeout")
+	AssertEquals(t, Milliseconds(500), config.Healthz.CacheTTL, "Healthz cache TTL")
+	AssertEquals(t, Seconds(300), config.TLS.ReloadInterval, "TLS reload interval")
+
+	for _, data := range []string{"default_ttl: 1500ms", "default_ttl: forever", "default_ttl: 1.5d", "cassandra:\n  query_timeout_ms: 1us"} {
+		if _, err := NewConfig([]byte(data)); err == nil {
+			t.Errorf("Invalid duration (%q) expected to fail!", data)
+		}
+	}
+}
+
+func TestUnknownKeys(t *testing.T) {
+	_, err := NewConfig([]byte("service_name: kask\ncassandra:\n  hsots: [cassandra1]"))
+	if err == nil {
+		t.Fatalf("Unknown key expected to fail!")
+	}
+	AssertEquals(t, true, strings.Contains(err.Error(), "line 3: unknown key hsots"), "Incorrect error: "+err.Error())
+}
+
+func TestPortValidation(t *testing.T) {
+	for _, data := range []string{"listen_port: 65536", "listen_port: -1", "admin:\n  listen_port: 70000", "cassandra:\n  port: 0"} {
+		if _, err := NewConfig([]byte(data)); err == nil {
+			t.Errorf("Port out of range (%q) expected to fail validation!", data)
+		}
+	}
+}
+
+func TestCassandraValidation(t *testing.T) {
+	testCases := []struct {
+		name string
+		data string
+	}{
+		{"No hosts", "cassandra:\n  hosts: []"},
+		{"Empty host", "cassandra:\n  hosts: [cassandra1, '']"},
+		{"Invalid keyspace", "cassandra:\n  keyspace: kask-sessions"},
+		{"Invalid table", "cassandra:\n  table: 1values"},
+		{"Invalid namespace keyspace", "namespaces:\n  - name: sessions\n    base_uri: /sessions/v1\n    keyspace: \"kask;\"\n    table: sessions"},
+		{"Zero query timeout", "cassandra:\n  query_timeout_ms: 0"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewConfig([]byte(tc.data)); err == nil {
+				t.Errorf("%s expected to fail validation!", tc.name)
+			}
+		})
+	}
+}
+
+func TestMigrationValidation(t *testing.T) {
+	testCases := []struct {
+		name string
+		data string
+	}{
+		{"Nothing to migrate from", "migration:\n  enabled: true"},
+		{"Empty host", "migration:\n  enabled: true\n  cassandra:\n    hosts: ['']"},
+		{"Invalid port", "migration:\n  enabled: true\n  cassandra:\n    hosts: [cassandra1]\n    port: 70000"},
+		{"No such namespace", "migration:\n  enabled: true\n  tables:\n    sessions:\n      table: values"},
+		{"Invalid table", "migration:\n  enabled: true\n  tables:\n    default:\n      table: 1values"},
+		{"Password w/ password file", "migration:\n  enabled: true\n  cassandra:\n    hosts: [cassandra1]\n    authentication:\n      username: kask\n      password: secret\n      password_file: /etc/kask/old_password"},
+		{"Password w/o username", "migration:\n  enabled: true\n  cassandra:\n    hosts: [cassandra1]\n    authentication:\n      password: secret"},
+		{"TLS cert w/o CA", "migration:\n  enabled: true\n  cassandra:\n    hosts: [cassandra1]\n    tls:\n      cert: /path/to/cert\n      key: /path/to/key"},
+		{"TLS cert w/o key", "migration:\n  enabled: true\n  cassandra:\n    hosts: [cassandra1]\n    tls:\n      ca: /path/to/ca\n      cert: /path/to/cert"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewConfig([]byte(tc.data)); err == nil {
+				t.Errorf("%s expected to fail validation!", tc.name)
+			}
+		})
+	}
+}
+
+func TestMigrationSource(t *testing.T) {
+	config, err := NewConfig([]byte("cassandra:\n  port: 9043\n  query_timeout_ms: 5s\nmigration:\n  enabled: true\n  tables:\n    default:\n      table: old_values"))
+	if err != nil {
+		t.Fatalf("Unable to parse config: %s", err)
+	}
+
+	keyspace, table, ok := config.MigrationSource(&config.Namespaces[0])
+	AssertEquals(t, true, ok, "Namespace not migrating")
+	AssertEquals(t, config.Namespaces[0].Keyspace, keyspace, "Unexpected keyspace")
+	AssertEquals(t, "old_values", table, "Unexpected table")
+
+	// Unset settings of the old cluster default to those of the new
+	AssertEquals(t, 9043, config.Migration.Cassandra.Port, "Unexpected port")
+	AssertEquals(t, Milliseconds(5000), config.Migration.Cassandra.QueryTimeout, "Unexpected query timeout")
+
+	// Migrating a table to itself is a no-op
+	config.Migration.Tables["default"] = MigrationTable{}
+	_, _, ok = config.MigrationSource(&config.Namespaces[0])
+	AssertEquals(t, false, ok, "Namespace migrating from itself")
+
+	config.Migration.Enabled = false
+	config.Migration.Tables["default"] = MigrationTable{Table: "old_values"}
+	_, _, ok = config.MigrationSource(&config.Namespaces[0])
+	AssertEquals(t, false, ok, "Namespace migrating with migration disabled")
+}
+
 func TestNegativeTTL(t *testing.T) {
 	if _, err := NewConfig([]byte("default_ttl: -1")); err == nil {
 		t.Errorf("Negative TTLs are expected to fail validation!")
 	}
 }
 
+func TestNegativeHTTPCompressionMinSize(t *testing.T) {
+	if _, err := NewConfig([]byte("http_compression:\n  enabled: true\n  min_size: -1")); err == nil {
+		t.Errorf("Negative HTTP compression min_size expected to fail validation!")
+	}
+}
+
+func TestNegativeShutdownTimeout(t *testing.T) {
+	if _, err := NewConfig([]byte("shutdown:\n  timeout: -1")); err == nil {
+		t.Errorf("Negative shutdown timeout expected to fail validation!")
+	}
+}
+
+func TestZeroHealthzTimeout(t *testing.T) {
+	if _, err := NewConfig([]byte("healthz:\n  timeout_ms: 0")); err == nil {
+		t.Errorf("Zero healthz timeout expected to fail validation!")
+	}
+}
+
+func TestNegativeHTTPServerLimits(t *testing.T) {
+	for _, data := range []string{"http_server:\n  write_timeout_ms: -1", "http_server:\n  max_connections: -1"} {
+		if _, err := NewConfig([]byte(data)); err == nil {
+			t.Errorf("Negative HTTP server timeouts/limits (%q) expected to fail validation!", data)
+		}
+	}
+}
+
+func TestAdminValidation(t *testing.T) {
+	testCases := []struct {
+		name string
+		data string
+	}{
+		{"Base URI collides w/ metrics", "base_uri: /metrics"},
+		{"Base URI collides w/ healthz", "base_uri: /healthz"},
+		{"Base URI beneath healthz", "base_uri: /healthz/live/v1"},
+		{"Same address and port", "listen_port: 8080\nadmin:\n  listen_port: 8080"},
+		{"TLS w/o cert", "admin:\n  listen_port: 8081\n  tls: true"},
+		{"TLS w/o port", "tls:\n  cert: /path/to/cert\n  key: /path/to/key\nadmin:\n  tls: true"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewConfig([]byte(tc.data)); err == nil {
+				t.Errorf("Invalid admin config (%q) expected to fail validation!", tc.data)
+			}
+		})
+	}
+
+	t.Run("Base URI above admin paths", func(t *testing.T) {
+		if _, err := NewConfig([]byte("base_uri: /")); err != nil {
+			t.Errorf("Base URI of / expected to pass validation: %s", err)
+		}
+	})
+
+	t.Run("Base URI w/ admin listener", func(t *testing.T) {
+		if _, err := NewConfig([]byte("base_uri: /\nadmin:\n  listen_port: 8081")); err != nil {
+			t.Errorf("Base URI of / with an admin listener expected to pass validation: %s", err)
+		}
+	})
+}
+
+func TestSocketValidation(t *testing.T) {
+	testCases := []struct {
+		name string
+		data string
+	}{
+		{"Invalid mode", "listen_socket:\n  path: /run/kask.sock\n  mode: rw-rw----"},
+		{"No listeners", "listen_port: 0"},
+		{"Socket w/ client certificates", "tls:\n  cert: /path/to/cert\n  key: /path/to/key\n  client_ca: /path/to/ca\nlisten_socket:\n  path: /run/kask.sock"},
+		{"h2c w/ TLS only", "tls:\n  cert: /path/to/cert\n  key: /path/to/key\nhttp_server:\n  h2c: true"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewConfig([]byte(tc.data)); err == nil {
+				t.Errorf("Invalid listener config (%q) expected to fail validation!", tc.data)
+			}
+		})
+	}
+
+	t.Run("Socket only", func(t *testing.T) {
+		if _, err := NewConfig([]byte("listen_port: 0\nlisten_socket:\n  path: /run/kask.sock")); err != nil {
+			t.Errorf("Socket-only config expected to pass validation: %s", err)
+		}
+	})
+}
+
 func TestInvalidLogLevel(t *testing.T) {
 	if _, err := NewConfig([]byte("log_level: emergency")); err == nil {
 		t.Errorf("Invalid/unsupported log levels are expected to fail validation!")
@@ -129,6 +538,96 @@ func TestKaskTLSValidation(t *testing.T) {
 			t.Errorf("Unset key with assigned cert expected to fail validation!")
 		}
 	})
+
+	t.Run("Client CA w/o cert and key", func(t *testing.T) {
+		var data = []byte(fmt.Sprintf("tls:\n    client_ca: /path/to/ca"))
+		if _, err := NewConfig(data); err == nil {
+			t.Errorf("Client CA without cert and key expected to fail validation!")
+		}
+	})
+
+	t.Run("Invalid client auth", func(t *testing.T) {
+		var data = []byte(fmt.Sprintf("tls:\n    cert: /path/to/cert\n    key: /path/to/key\n    client_ca: /path/to/ca\n    client_auth: sometimes"))
+		if _, err := NewConfig(data); err == nil {
+			t.Errorf("Invalid client_auth value expected to fail validation!")
+		}
+	})
+
+	t.Run("Negative reload interval", func(t *testing.T) {
+		var data = []byte(fmt.Sprintf("tls:\n    cert: /path/to/cert\n    key: /path/to/key\n    reload_interval: -1"))
+		if _, err := NewConfig(data); err == nil {
+			t.Errorf("Negative reload_interval expected to fail validation!")
+		}
+	})
+
+	t.Run("Invalid TLS parameters", func(t *testing.T) {
+		for _, params := range []string{
+			"min_version: 1.4",
+			"min_version: \"1.3\"\n    max_version: \"1.2\"",
+			"cipher_suites: [TLS_RSA_WITH_RC4_128_SHA]",
+			"min_version: \"1.3\"\n    cipher_suites: [TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256]",
+			"curves: [P-224]",
+		} {
+			var data = []byte(fmt.Sprintf("tls:\n    cert: /path/to/cert\n    key: /path/to/key\n    %s", params))
+			if _, err := NewConfig(data); err == nil {
+				t.Errorf("Invalid TLS parameters (%q) expected to fail validation!", params)
+			}
+		}
+	})
+
+	t.Run("Allowed clients w/o client CA", func(t *testing.T) {
+		var data = []byte(fmt.Sprintf("tls:\n    cert: /path/to/cert\n    key: /path/to/key\n    allowed_clients:\n      read: [mw1001]"))
+		if _, err := NewConfig(data); err == nil {
+			t.Errorf("Allowed clients without a client CA expected to fail validation!")
+		}
+	})
+}
+
+func TestAuthenticationValidation(t *testing.T) {
+	t.Run("Short HMAC secret", func(t *testing.T) {
+		if _, err := NewConfig([]byte("authentication:\n  hmac_secret: tooshort")); err == nil {
+			t.Errorf("HMAC secret of insufficient length expected to fail validation!")
+		}
+	})
+
+	t.Run("HMAC secret w/ secret file", func(t *testing.T) {
+		data := "authentication:\n  hmac_secret: 0123456789abcdef0123456789abcdef\n  hmac_secret_file: /etc/kask/hmac_secret"
+		if _, err := NewConfig([]byte(data)); err == nil {
+			t.Errorf("HMAC secret and secret file expected to fail validation!")
+		}
+	})
+}
+
+func TestAuthorizationValidation(t *testing.T) {
+	var auth = "authentication:\n  hmac_secret: 0123456789abcdef0123456789abcdef\n"
+
+	config, err := NewConfig([]byte(auth + "authorization:\n  - identity: hmac:mediawiki\n    prefixes: [\"mw:\"]\n    methods: [get, post]"))
+	if err != nil {
+		t.Fatalf("Failed to read configuration data: %v", err)
+	}
+	AssertEquals(t, config.Authorization[0].Methods[0], "GET", "Normalized method")
+
+	testCases := []struct {
+		name string
+		data string
+	}{
+		{"Without authentication", "authorization:\n  - identity: hmac:mediawiki\n    prefixes: [\"\"]\n    methods: [GET]"},
+		{"Missing identity", auth + "authorization:\n  - prefixes: [\"\"]\n    methods: [GET]"},
+		{"Unqualified identity", auth + "authorization:\n  - identity: mediawiki\n    prefixes: [\"\"]\n    methods: [GET]"},
+		{"Unknown identity source", auth + "authorization:\n  - identity: ldap:mediawiki\n    prefixes: [\"\"]\n    methods: [GET]"},
+		{"Empty qualified identity", auth + "authorization:\n  - identity: \"hmac:\"\n    prefixes: [\"\"]\n    methods: [GET]"},
+		{"Missing prefixes", auth + "authorization:\n  - identity: hmac:mediawiki\n    methods: [GET]"},
+		{"Missing methods", auth + "authorization:\n  - identity: hmac:mediawiki\n    prefixes: [\"\"]"},
+		{"Invalid method", auth + "authorization:\n  - identity: hmac:mediawiki\n    prefixes: [\"\"]\n    methods: [PATCH]"},
+		{"Unknown namespace", auth + "authorization:\n  - identity: hmac:mediawiki\n    namespaces: [kittens]\n    prefixes: [\"\"]\n    methods: [GET]"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewConfig([]byte(tc.data)); err == nil {
+				t.Errorf("%s expected to fail validation!", tc.name)
+			}
+		})
+	}
 }
 
 func TestCassandraAuthenticationValidation(t *testing.T) {
@@ -150,6 +649,26 @@ cassandra:
 		}
 
 	})
+
+	t.Run("Password file w/o username", func(t *testing.T) {
+		if _, err := NewConfig([]byte(fmt.Sprintf(data, "password_file"))); err == nil {
+			t.Errorf("Unset username and assigned password file expected to fail validation!")
+		}
+	})
+
+	t.Run("Password w/ password file", func(t *testing.T) {
+		data := "cassandra:\n  authentication:\n    username: kask\n    password: secret\n    password_file: /etc/kask/cassandra_password"
+		if _, err := NewConfig([]byte(data)); err == nil {
+			t.Errorf("Password and password file expected to fail validation!")
+		}
+	})
+
+	t.Run("Username w/ password file", func(t *testing.T) {
+		data := "cassandra:\n  authentication:\n    username: kask\n    password_file: /etc/kask/cassandra_password"
+		if _, err := NewConfig([]byte(data)); err != nil {
+			t.Errorf("Username and password file expected to pass validation: %s", err)
+		}
+	})
 }
 
 func TestCaValidation(t *testing.T) {
@@ -0,0 +1,200 @@
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Content-codings of responses, in order of preference (where the client has none).
+var responseCodings = []string{"br", "gzip"}
+
+// encoder is a (reusable) compressing writer.
+type encoder interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+// Pools of encoders, by content-coding.
+var encoders = map[string]*sync.Pool{
+	"br":   {New: func() interface{} { return brotli.NewWriter(nil) }},
+	"gzip": {New: func() interface{} { return gzip.NewWriter(nil) }},
+}
+
+// negotiateEncoding returns the response content-coding most preferred by the client, or an empty string if
+// it accepts none of them.
+func negotiateEncoding(r *http.Request) string {
+	var coding string
+	var quality float64
+
+	for _, c := range responseCodings {
+		if q := encodingQuality(r, c); q > quality {
+			coding, quality = c, q
+		}
+	}
+
+	return coding
+}
+
+// compressingResponseWriter is an http.ResponseWriter that compresses response bodies of at least minSize
+// bytes.  The response header is deferred until either minSize bytes have been written, or the writer is
+// closed (whichever is first); Only then is it known whether the body is to be compressed.
+type compressingResponseWriter struct {
+	http.ResponseWriter
+	coding  string
+	minSize int
+	status  int
+	buffer  []byte
+	started bool
+	encoder encoder
+}
+
+// WriteHeader records the status code (to be sent once the header is).
+func (w *compressingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// Write buffers the response body until it is known whether it should be compressed, and compresses it if so.
+func (w *compressingResponseWriter) Write(p []byte) (int, error) {
+	if w.started {
+		if w.encoder != nil {
+			return w.encoder.Write(p)
+		}
+		return w.ResponseWriter.Write(p)
+	}
+
+	w.buffer = append(w.buffer, p...)
+	if len(w.buffer) >= w.minSize {
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// start sends the response header (compressing the body, if requested and appropriate), followed by anything
+// buffered.
+func (w *compressingResponseWriter) start(compress bool) error {
+	w.started = true
+
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	// Only successful responses are compressed, and never those already encoded (i.e. values stored compressed).
+	if compress && w.status == http.StatusOK && w.Header().Get("Content-Encoding") == "" {
+		w.Header().Set("Content-Encoding", w.coding)
+		w.Header().Del("Content-Length")
+		w.encoder = encoders[w.coding].Get().(encoder)
+		w.encoder.Reset(w.ResponseWriter)
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+
+	buffered := w.buffer
+	w.buffer = nil
+
+	if len(buffered) == 0 {
+		return nil
+	}
+
+	if w.encoder != nil {
+		_, err := w.encoder.Write(buffered)
+		return err
+	}
+
+	_, err := w.ResponseWriter.Write(buffered)
+	return err
+}
+
+// Close completes the response; Responses smaller than minSize are sent uncompressed.
+func (w *compressingResponseWriter) Close() error {
+	if !w.started {
+		if err := w.start(false); err != nil {
+			return err
+		}
+	}
+
+	if w.encoder == nil {
+		return nil
+	}
+
+	err := w.encoder.Close()
+	encoders[w.coding].Put(w.encoder)
+	w.encoder = nil
+
+	return err
+}
+
+// CompressionMiddleware returns HTTP middleware that compresses response bodies of at least minSize bytes, using
+// the content-coding (gzip or br) negotiated with the client's Accept-Encoding.  Request bodies (of POST and PUT)
+// with a Content-Encoding of gzip are decompressed (to at most maxDecompressedSize bytes); Those of any other
+// coding are rejected with an UnsupportedMediaType problem.
+func CompressionMiddleware(minSize int, logger *Logger, next http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost || r.Method == http.MethodPut {
+			switch coding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); coding {
+			case "", "identity":
+			case "gzip":
+				reader, err := gzip.NewReader(r.Body)
+				if err != nil {
+					HTTPError(w, BadRequest(r.URL.Path))
+					logger.RequestID(getRequestID(r)).Log(LogError, "Invalid gzip request body (%s)", err)
+					return
+				}
+				defer reader.Close()
+
+				// Bound the decompressed size, regardless of max_value_size (which may be unlimited).
+				r.Body = http.MaxBytesReader(w, reader, maxDecompressedSize)
+				r.ContentLength = -1
+				r.Header.Del("Content-Encoding")
+			default:
+				// See: https://tools.ietf.org/html/rfc7694
+				w.Header().Set("Accept-Encoding", "gzip")
+				HTTPError(w, UnsupportedMediaType(r.URL.Path))
+				logger.RequestID(getRequestID(r)).Log(LogError, "Unsupported request Content-Encoding (%s)", coding)
+				return
+			}
+		}
+
+		// The representation depends upon the request's Accept-Encoding
+		addVary(w.Header(), "Accept-Encoding")
+
+		coding := negotiateEncoding(r)
+		if coding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressingResponseWriter{ResponseWriter: w, coding: coding, minSize: minSize}
+		next.ServeHTTP(cw, r)
+
+		if err := cw.Close(); err != nil {
+			logger.RequestID(getRequestID(r)).Log(LogError, "Error writing compressed HTTP response body: (%s)", err)
+		}
+	})
+}
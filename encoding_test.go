@@ -0,0 +1,203 @@
+//go:build unit
+// +build unit
+
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	testCases := []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, gzip;q=0", ""},
+		{"*", "br"},
+		{"*;q=0.1, gzip;q=0.5", "gzip"},
+		{"zstd", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.acceptEncoding, func(t *testing.T) {
+			req := httptest.NewRequest("GET", path.Join(prefixURI, "cat"), nil)
+			if tc.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+			AssertEquals(t, tc.expected, negotiateEncoding(req), "Incorrect content-coding")
+		})
+	}
+}
+
+func TestCompressionMiddleware(t *testing.T) {
+	logger, err := NewLogger(ioutil.Discard, "kask", "info")
+	if err != nil {
+		t.Fatalf("Unable to create Logger instance: %s", err)
+	}
+
+	large := bytes.Repeat([]byte("meow"), 512)
+
+	handler := func(status int, body []byte, header map[string]string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for k, v := range header {
+				w.Header().Set(k, v)
+			}
+			w.WriteHeader(status)
+			w.Write(body)
+		})
+	}
+
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"":     func(r io.Reader) (io.Reader, error) { return r, nil },
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"br":   func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+	}
+
+	testCases := []struct {
+		name           string
+		acceptEncoding string
+		next           http.Handler
+		expected       string
+	}{
+		{"gzip", "gzip", handler(200, large, nil), "gzip"},
+		{"brotli", "br, gzip", handler(200, large, nil), "br"},
+		{"Below minimum size", "gzip", handler(200, large[:100], nil), ""},
+		{"Not accepted", "", handler(200, large, nil), ""},
+		{"Not successful", "gzip", handler(404, large, nil), ""},
+		{"Already encoded", "gzip", handler(200, large, map[string]string{"Content-Encoding": "zstd"}), "zstd"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", path.Join(prefixURI, "cat"), nil)
+			if tc.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+			rr := httptest.NewRecorder()
+
+			CompressionMiddleware(1024, logger, tc.next).ServeHTTP(rr, req)
+
+			AssertEquals(t, tc.expected, rr.Header().Get("Content-Encoding"), "Incorrect Content-Encoding")
+			AssertEquals(t, "Accept-Encoding", rr.Header().Get("Vary"), "Incorrect Vary")
+
+			decode, ok := decoders[tc.expected]
+			if !ok {
+				return
+			}
+
+			reader, err := decode(rr.Body)
+			if err != nil {
+				t.Fatalf("Unable to decode response body: %s", err)
+			}
+			body, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("Unable to decode response body: %s", err)
+			}
+			if !bytes.HasPrefix(large, body) || len(body) < 100 {
+				t.Errorf("Incorrect response body")
+			}
+		})
+	}
+}
+
+func TestCompressedRequestBodyLimit(t *testing.T) {
+	config, err := NewConfig([]byte{})
+	if err != nil {
+		t.Fatalf("Unable to create Config instance: %s", err)
+	}
+	logger, err := NewLogger(ioutil.Discard, "kask", "info")
+	if err != nil {
+		t.Fatalf("Unable to create Logger instance: %s", err)
+	}
+
+	// A (highly compressible) body that decompresses to more than the limit, with max_value_size unlimited.
+	var compressed bytes.Buffer
+	writer, _ := gzip.NewWriterLevel(&compressed, gzip.BestSpeed)
+	writer.Write(make([]byte, maxDecompressedSize+1))
+	writer.Close()
+
+	handler := ValidatingKeyParserMiddleware(prefixURI, NewHTTPHandler(newMockStore(), config, &config.Namespaces[0], logger))
+
+	req := httptest.NewRequest("POST", path.Join(prefixURI, "cat"), bytes.NewReader(compressed.Bytes()))
+	req.Header.Set("Content-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+
+	CompressionMiddleware(1024, logger, handler).ServeHTTP(rr, req)
+
+	AssertEquals(t, http.StatusRequestEntityTooLarge, rr.Code, "Incorrect status code")
+}
+
+func TestCompressedRequestBody(t *testing.T) {
+	logger, err := NewLogger(ioutil.Discard, "kask", "info")
+	if err != nil {
+		t.Fatalf("Unable to create Logger instance: %s", err)
+	}
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte("meow"))
+	writer.Close()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatalf("Unable to read request body: %s", err)
+		}
+		AssertEquals(t, "meow", string(body), "Incorrect request body")
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	testCases := []struct {
+		name            string
+		contentEncoding string
+		body            []byte
+		statusCode      int
+	}{
+		{"Uncompressed", "", []byte("meow"), 201},
+		{"gzip", "gzip", compressed.Bytes(), 201},
+		{"Invalid gzip", "gzip", []byte("meow"), 400},
+		{"Unsupported", "compress", []byte("meow"), 415},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", path.Join(prefixURI, "cat"), bytes.NewReader(tc.body))
+			if tc.contentEncoding != "" {
+				req.Header.Set("Content-Encoding", tc.contentEncoding)
+			}
+			rr := httptest.NewRecorder()
+
+			CompressionMiddleware(1024, logger, handler).ServeHTTP(rr, req)
+
+			AssertEquals(t, tc.statusCode, rr.Code, "Incorrect status code")
+		})
+	}
+}
@@ -0,0 +1,309 @@
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Encrypted values are stored as an envelope of: magic, key ID length (1 byte), key ID, nonce, and ciphertext.
+var envelopeMagic = []byte("KASK\x01")
+
+// Keyring is a set of data encryption keys; Values are encrypted with the primary key, and can be decrypted
+// with any of the keys.
+type Keyring struct {
+	filename string
+
+	mu      sync.RWMutex
+	primary string
+	aeads   map[string]cipher.AEAD
+}
+
+// ReadKeyring returns a new Keyring from a YAML file.  The file contains a map of key ID to (base64 encoded)
+// AES-128, -192, or -256 key, and the ID of the primary key, i.e.
+//
+//	primary: 2019-06
+//	keys:
+//	  2019-06: KrwbQpQ1jkzz6hC0CxqICCGNpB7FOcHxUMf/9RJYUpw=
+//	  2019-01: 1pHmxHANvQPV9lzjZlsPLS8ZlSnkd4rl4CNUNVzJeis=
+func ReadKeyring(filename string) (*Keyring, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	keyring, err := NewKeyring(data)
+	if err != nil {
+		return nil, err
+	}
+
+	keyring.filename = filename
+	return keyring, nil
+}
+
+// Reload re-reads the keyring file (i.e. to add a new primary key); On error, the keys previously read remain in
+// use.
+func (k *Keyring) Reload() error {
+	if k.filename == "" {
+		return nil
+	}
+
+	keyring, err := ReadKeyring(k.filename)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	k.primary, k.aeads = keyring.primary, keyring.aeads
+	k.mu.Unlock()
+
+	return nil
+}
+
+// NewKeyring returns a new Keyring from YAML serialized as bytes.
+func NewKeyring(data []byte) (*Keyring, error) {
+	var file struct {
+		Primary string            `yaml:"primary"`
+		Keys    map[string]string `yaml:"keys"`
+	}
+
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	if _, ok := file.Keys[file.Primary]; !ok {
+		return nil, fmt.Errorf("primary key %q not found in keyring", file.Primary)
+	}
+
+	keyring := &Keyring{primary: file.Primary, aeads: make(map[string]cipher.AEAD)}
+
+	for id, encoded := range file.Keys {
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("invalid key ID %q (must be 1-255 bytes)", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode key %q: %s", id, err)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %s", id, err)
+		}
+
+		if keyring.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+
+	return keyring, nil
+}
+
+// Primary returns the ID of the key used for encryption.
+func (k *Keyring) Primary() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.primary
+}
+
+// Encrypt returns an envelope containing value, encrypted with the primary key.  The key associated with the
+// value is authenticated (but not encrypted), so that values cannot be swapped from one key to another.
+func (k *Keyring) Encrypt(key string, value []byte) ([]byte, error) {
+	k.mu.RLock()
+	primary, aead := k.primary, k.aeads[k.primary]
+	k.mu.RUnlock()
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	envelope := make([]byte, 0, len(envelopeMagic)+1+len(primary)+len(nonce)+len(value)+aead.Overhead())
+	envelope = append(envelope, envelopeMagic...)
+	envelope = append(envelope, byte(len(primary)))
+	envelope = append(envelope, primary...)
+	envelope = append(envelope, nonce...)
+
+	return aead.Seal(envelope, nonce, value, []byte(key)), nil
+}
+
+// Decrypt returns the value contained in an envelope, and the ID of the key used to encrypt it.  Values that
+// are not enveloped (i.e. those written before encryption was enabled) are returned as-is, with an empty key ID.
+func (k *Keyring) Decrypt(key string, envelope []byte) ([]byte, string, error) {
+	if !bytes.HasPrefix(envelope, envelopeMagic) {
+		return envelope, "", nil
+	}
+
+	rest := envelope[len(envelopeMagic):]
+	if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+		return nil, "", errors.New("truncated encryption envelope")
+	}
+
+	id := string(rest[1 : 1+int(rest[0])])
+	rest = rest[1+int(rest[0]):]
+
+	k.mu.RLock()
+	aead, ok := k.aeads[id]
+	k.mu.RUnlock()
+	if !ok {
+		return nil, id, fmt.Errorf("value encrypted with unknown key %q", id)
+	}
+
+	if len(rest) < aead.NonceSize() {
+		return nil, id, errors.New("truncated encryption envelope")
+	}
+
+	value, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], []byte(key))
+	if err != nil {
+		return nil, id, fmt.Errorf("unable to decrypt value with key %q: %s", id, err)
+	}
+
+	return value, id, nil
+}
+
+// EncryptingStore is a Store that encrypts values (using a Keyring) before passing them to another Store.
+type EncryptingStore struct {
+	next    Store
+	keyring *Keyring
+}
+
+// NewEncryptingStore returns an EncryptingStore that wraps next.
+func NewEncryptingStore(next Store, keyring *Keyring) *EncryptingStore {
+	return &EncryptingStore{next, keyring}
+}
+
+// Set encrypts a value, and stores it.
+func (s *EncryptingStore) Set(key string, value []byte, ttl int) error {
+	envelope, err := s.keyring.Encrypt(key, value)
+	if err != nil {
+		return err
+	}
+	return s.next.Set(key, envelope, ttl)
+}
+
+// Get retrieves a value, and decrypts it.
+func (s *EncryptingStore) Get(key string) (Datum, error) {
+	datum, err := s.next.Get(key)
+	if err != nil {
+		return datum, err
+	}
+
+	if datum.Value, _, err = s.keyring.Decrypt(key, datum.Value); err != nil {
+		return Datum{}, err
+	}
+
+	return datum, nil
+}
+
+// Delete removes a value.
+func (s *EncryptingStore) Delete(key string) error {
+	return s.next.Delete(key)
+}
+
+// Touch resets the TTL of a value (the encrypted value is rewritten as-is).
+func (s *EncryptingStore) Touch(key string, ttl int) error {
+	return s.next.Touch(key, ttl)
+}
+
+// Close closes the wrapped Store.
+func (s *EncryptingStore) Close() {
+	s.next.Close()
+}
+
+// reencryptionSplits is the number of token ranges re-encryption scans (one after another), bounding each query.
+const reencryptionSplits = 256
+
+// ScanningStore provides iteration over, and conditional updates of, (raw) stored values.
+type ScanningStore interface {
+	RangeScanner
+	// CompareAndSet stores a new value for a key, only if the current value is old.
+	CompareAndSet(key string, old []byte, value []byte, ttl int) (bool, error)
+}
+
+// ReencryptionStats summarizes the outcome of a re-encryption.
+type ReencryptionStats struct {
+	Scanned     int
+	Reencrypted int
+	Conflicts   int
+	Errors      int
+}
+
+// Reencrypt scans storage (range by range; See tokenRanges), and re-encrypts (with the primary key) any value that
+// is unencrypted, or was encrypted with another key.  Values are written with their remaining TTL, and only if
+// unchanged since they were read; Those that changed (conflicts) were rewritten since the scan began, and are left
+// as-is.
+func Reencrypt(store ScanningStore, keyring *Keyring, logger *Logger) (ReencryptionStats, error) {
+	var stats ReencryptionStats
+
+	reencrypt := func(key string, datum Datum) error {
+		stats.Scanned++
+
+		if stats.Scanned%10000 == 0 {
+			logger.Info("Re-encryption progress: %d scanned, %d re-encrypted", stats.Scanned, stats.Reencrypted)
+		}
+
+		value, id, err := keyring.Decrypt(key, datum.Value)
+		if err != nil {
+			logger.Error("Unable to decrypt value of %q: %s", key, err)
+			stats.Errors++
+			return nil
+		}
+
+		if id == keyring.Primary() {
+			return nil
+		}
+
+		envelope, err := keyring.Encrypt(key, value)
+		if err != nil {
+			return err
+		}
+
+		applied, err := store.CompareAndSet(key, datum.Value, envelope, datum.TTL)
+		switch {
+		case err != nil:
+			logger.Error("Unable to write re-encrypted value of %q: %s", key, err)
+			stats.Errors++
+		case applied:
+			stats.Reencrypted++
+		default:
+			stats.Conflicts++
+		}
+
+		return nil
+	}
+
+	for _, r := range tokenRanges(reencryptionSplits) {
+		if err := store.ScanRange(r[0], r[1], reencrypt); err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, nil
+}
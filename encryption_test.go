@@ -0,0 +1,209 @@
+//go:build unit
+// +build unit
+
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const (
+	keyA = "KrwbQpQ1jkzz6hC0CxqICCGNpB7FOcHxUMf/9RJYUpw="
+	keyB = "1pHmxHANvQPV9lzjZlsPLS8ZlSnkd4rl4CNUNVzJeis="
+)
+
+func newTestKeyring(t *testing.T, data string) *Keyring {
+	keyring, err := NewKeyring([]byte(data))
+	if err != nil {
+		t.Fatalf("Unable to create Keyring: %s", err)
+	}
+	return keyring
+}
+
+func TestKeyring(t *testing.T) {
+	t.Run("Invalid", func(t *testing.T) {
+		testCases := []struct {
+			name string
+			data string
+		}{
+			{"Missing primary", "primary: b\nkeys:\n  a: " + keyA},
+			{"Invalid base64", "primary: a\nkeys:\n  a: '!!!'"},
+			{"Invalid key size", "primary: a\nkeys:\n  a: c2hvcnQ="},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				if _, err := NewKeyring([]byte(tc.data)); err == nil {
+					t.Errorf("%s expected to fail!", tc.name)
+				}
+			})
+		}
+	})
+
+	t.Run("Round trip", func(t *testing.T) {
+		keyring := newTestKeyring(t, "primary: a\nkeys:\n  a: "+keyA)
+
+		envelope, err := keyring.Encrypt("cat", []byte("meow"))
+		if err != nil {
+			t.Fatalf("Encryption failed: %s", err)
+		}
+		if bytes.Contains(envelope, []byte("meow")) {
+			t.Errorf("Envelope contains plaintext")
+		}
+
+		value, id, err := keyring.Decrypt("cat", envelope)
+		if err != nil {
+			t.Fatalf("Decryption failed: %s", err)
+		}
+		AssertEquals(t, "meow", string(value), "Incorrect decrypted value")
+		AssertEquals(t, "a", id, "Incorrect key ID")
+
+		if _, _, err := keyring.Decrypt("dog", envelope); err == nil {
+			t.Errorf("Decryption of value associated with another key expected to fail!")
+		}
+		if _, _, err := keyring.Decrypt("cat", envelope[:len(envelope)-1]); err == nil {
+			t.Errorf("Decryption of truncated value expected to fail!")
+		}
+	})
+
+	t.Run("Plaintext", func(t *testing.T) {
+		keyring := newTestKeyring(t, "primary: a\nkeys:\n  a: "+keyA)
+
+		value, id, err := keyring.Decrypt("cat", []byte("meow"))
+		if err != nil {
+			t.Fatalf("Decryption failed: %s", err)
+		}
+		AssertEquals(t, "meow", string(value), "Incorrect plaintext value")
+		AssertEquals(t, "", id, "Incorrect key ID")
+	})
+
+	t.Run("Rotation", func(t *testing.T) {
+		before := newTestKeyring(t, "primary: a\nkeys:\n  a: "+keyA)
+		after := newTestKeyring(t, "primary: b\nkeys:\n  a: "+keyA+"\n  b: "+keyB)
+		removed := newTestKeyring(t, "primary: b\nkeys:\n  b: "+keyB)
+
+		envelope, _ := before.Encrypt("cat", []byte("meow"))
+
+		if value, id, err := after.Decrypt("cat", envelope); err != nil || string(value) != "meow" || id != "a" {
+			t.Errorf("Decryption with non-primary key failed (%s)", err)
+		}
+		if _, _, err := removed.Decrypt("cat", envelope); err == nil {
+			t.Errorf("Decryption with a removed key expected to fail!")
+		}
+	})
+}
+
+func TestKeyringReload(t *testing.T) {
+	filename := writeTempFile(t, "primary: a\nkeys:\n  a: "+keyA)
+	defer os.Remove(filename)
+
+	keyring, err := ReadKeyring(filename)
+	if err != nil {
+		t.Fatalf("Unable to read Keyring: %s", err)
+	}
+
+	envelope, err := keyring.Encrypt("key", []byte("value"))
+	if err != nil {
+		t.Fatalf("Unable to encrypt: %s", err)
+	}
+
+	// Add a new primary key
+	if err := ioutil.WriteFile(filename, []byte("primary: b\nkeys:\n  a: "+keyA+"\n  b: "+keyB), 0600); err != nil {
+		t.Fatalf("Unable to write keyring: %s", err)
+	}
+	if err := keyring.Reload(); err != nil {
+		t.Fatalf("Unable to reload Keyring: %s", err)
+	}
+	AssertEquals(t, "b", keyring.Primary(), "Incorrect primary key")
+
+	// Values encrypted with the previous primary remain readable.
+	value, id, err := keyring.Decrypt("key", envelope)
+	if err != nil {
+		t.Fatalf("Unable to decrypt: %s", err)
+	}
+	AssertEquals(t, "value", string(value), "Incorrect value")
+	AssertEquals(t, "a", id, "Incorrect key ID")
+
+	// An invalid keyring leaves the current keys in place.
+	if err := ioutil.WriteFile(filename, []byte("primary: c\nkeys:\n  a: "+keyA), 0600); err != nil {
+		t.Fatalf("Unable to write keyring: %s", err)
+	}
+	if err := keyring.Reload(); err == nil {
+		t.Errorf("Reload of invalid keyring expected to fail!")
+	}
+	AssertEquals(t, "b", keyring.Primary(), "Incorrect primary key")
+}
+
+func TestEncryptingStore(t *testing.T) {
+	backend := newMockStore()
+	store := NewEncryptingStore(backend, newTestKeyring(t, "primary: a\nkeys:\n  a: "+keyA))
+
+	if err := store.Set("cat", []byte("meow"), 60); err != nil {
+		t.Fatalf("Error storing value: %s", err)
+	}
+
+	if bytes.Equal(backend.data["cat"].Value, []byte("meow")) {
+		t.Errorf("Value stored as plaintext")
+	}
+
+	datum, err := store.Get("cat")
+	if err != nil {
+		t.Fatalf("Error retrieving value: %s", err)
+	}
+	AssertEquals(t, "meow", string(datum.Value), "Incorrect value")
+	AssertEquals(t, 60, datum.TTL, "Incorrect TTL")
+}
+
+func TestReencrypt(t *testing.T) {
+	logger, err := NewLogger(ioutil.Discard, "kask", "info")
+	if err != nil {
+		t.Fatalf("Unable to create Logger instance: %s", err)
+	}
+
+	before := newTestKeyring(t, "primary: a\nkeys:\n  a: "+keyA)
+	after := newTestKeyring(t, "primary: b\nkeys:\n  a: "+keyA+"\n  b: "+keyB)
+
+	store := newMockStore()
+	NewEncryptingStore(store, before).Set("old", []byte("meow"), 60)
+	NewEncryptingStore(store, after).Set("new", []byte("woof"), 0)
+	store.Set("plain", []byte("roar"), 30)
+
+	stats, err := Reencrypt(store, after, logger)
+	if err != nil {
+		t.Fatalf("Re-encryption failed: %s", err)
+	}
+
+	AssertEquals(t, 3, stats.Scanned, "Values scanned")
+	AssertEquals(t, 2, stats.Reencrypted, "Values re-encrypted")
+	AssertEquals(t, 0, stats.Errors, "Errors")
+
+	expected := map[string]Datum{"old": {[]byte("meow"), 60}, "new": {[]byte("woof"), 0}, "plain": {[]byte("roar"), 30}}
+	for key, exp := range expected {
+		value, id, err := after.Decrypt(key, store.data[key].Value)
+		if err != nil {
+			t.Fatalf("Decryption of %s failed: %s", key, err)
+		}
+		AssertEquals(t, "b", id, "Key ID of "+key)
+		AssertEquals(t, string(exp.Value), string(value), "Value of "+key)
+		AssertEquals(t, exp.TTL, store.data[key].TTL, "TTL of "+key)
+	}
+}
@@ -0,0 +1,276 @@
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record is a key, its (stored) value, and when it expires (as a Unix timestamp, or 0 if it never expires);
+// Exports are newline delimited JSON (NDJSON) records, one per line.
+type Record struct {
+	Key       string `json:"key"`
+	Value     []byte `json:"value"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// RangeScanner provides iteration over the (raw) stored values within ranges of (Murmur3) tokens.
+type RangeScanner interface {
+	// ScanRange invokes a function for every key and value with a token in (start, end]; Iteration ends if it
+	// returns an error.
+	ScanRange(start, end int64, fn func(string, Datum) error) error
+}
+
+// ExportStats summarizes an export.
+type ExportStats struct {
+	Ranges   int
+	Exported int64
+}
+
+// tokenRanges divides the Murmur3 token ring into n (contiguous) ranges, each represented by its (exclusive)
+// start and (inclusive) end token.
+func tokenRanges(n int) [][2]int64 {
+	ranges := make([][2]int64, n)
+	width := math.MaxUint64 / uint64(n)
+
+	start := int64(math.MinInt64)
+	for i := range ranges {
+		end := int64(uint64(start) + width)
+		if i == n-1 {
+			end = math.MaxInt64
+		}
+		ranges[i] = [2]int64{start, end}
+		start = end
+	}
+
+	return ranges
+}
+
+// Export writes every value to w, as NDJSON Records (in no particular order).  The token ring is divided into
+// splits ranges, scanned concurrently (at most concurrency at once).
+func Export(store RangeScanner, w io.Writer, splits, concurrency int, logger *Logger) (ExportStats, error) {
+	stats := ExportStats{Ranges: splits}
+
+	var mu sync.Mutex
+	encoder := json.NewEncoder(w)
+
+	write := func(key string, datum Datum) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		record := Record{Key: key, Value: datum.Value}
+		if datum.TTL > 0 {
+			record.ExpiresAt = time.Now().Unix() + int64(datum.TTL)
+		}
+
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+
+		stats.Exported++
+		if stats.Exported%10000 == 0 {
+			logger.Info("Export progress: %d exported", stats.Exported)
+		}
+		return nil
+	}
+
+	ranges := make(chan [2]int64)
+	errc := make(chan error, concurrency)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range ranges {
+				if err := store.ScanRange(r[0], r[1], write); err != nil {
+					errc <- fmt.Errorf("scan of token range (%d, %d] failed: %s", r[0], r[1], err)
+					return
+				}
+			}
+		}()
+	}
+
+	// Feed the token ranges to the workers, until done (or any of them fails).
+	var err error
+feed:
+	for _, r := range tokenRanges(splits) {
+		select {
+		case ranges <- r:
+		case err = <-errc:
+			break feed
+		}
+	}
+	close(ranges)
+	wg.Wait()
+
+	// Any error of the (remaining) workers
+	if err == nil && len(errc) > 0 {
+		err = <-errc
+	}
+
+	return stats, err
+}
+
+// ImportStats summarizes an import.
+type ImportStats struct {
+	// Records skipped (those already imported, according to the checkpoint)
+	Skipped int64
+	// Records that had expired (and were not imported)
+	Expired  int64
+	Imported int64
+}
+
+// Importer replays NDJSON Records into a Store.
+type Importer struct {
+	store  Store
+	logger *Logger
+	now    func() time.Time
+	// Maximum records written per second (0 is unlimited)
+	rate int
+	// File recording the number of records imported (if non-empty), so that an interrupted import can be resumed
+	checkpoint string
+	// Records imported between checkpoints
+	interval int64
+}
+
+// NewImporter returns an Importer that writes to store, at most rate records per second (if rate is greater than
+// zero), checkpointing its progress to a file (if checkpoint is non-empty).
+func NewImporter(store Store, rate int, checkpoint string, logger *Logger) *Importer {
+	return &Importer{store: store, logger: logger, now: time.Now, rate: rate, checkpoint: checkpoint, interval: 1000}
+}
+
+// Import writes each Record read from r, with the TTL remaining until it expires; Those already expired are not
+// written.  If a checkpoint exists, the records it counts as imported are skipped.
+func (imp *Importer) Import(r io.Reader) (ImportStats, error) {
+	var stats ImportStats
+
+	done, err := imp.readCheckpoint()
+	if err != nil {
+		return stats, err
+	}
+	if done > 0 {
+		imp.logger.Info("Resuming import from checkpoint (skipping %d records)", done)
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	start := time.Now()
+	var line int64
+
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		if line <= done {
+			stats.Skipped++
+			continue
+		}
+
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return stats, fmt.Errorf("line %d: %s", line, err)
+		}
+		if record.Key == "" {
+			return stats, fmt.Errorf("line %d: record has no key", line)
+		}
+
+		var ttl int
+		if record.ExpiresAt > 0 {
+			if ttl = int(record.ExpiresAt - imp.now().Unix()); ttl <= 0 {
+				stats.Expired++
+				continue
+			}
+		}
+
+		// Throttle; Wait until the rate would not be exceeded.
+		if imp.rate > 0 {
+			if ahead := time.Duration(stats.Imported)*time.Second/time.Duration(imp.rate) - time.Since(start); ahead > 0 {
+				time.Sleep(ahead)
+			}
+		}
+
+		if err := imp.store.Set(record.Key, record.Value, ttl); err != nil {
+			if cerr := imp.writeCheckpoint(line - 1); cerr != nil {
+				imp.logger.Error("Unable to write checkpoint: %s", cerr)
+			}
+			return stats, fmt.Errorf("line %d: unable to write %q: %s", line, record.Key, err)
+		}
+
+		stats.Imported++
+		if stats.Imported%imp.interval == 0 {
+			if err := imp.writeCheckpoint(line); err != nil {
+				return stats, err
+			}
+		}
+		if stats.Imported%10000 == 0 {
+			imp.logger.Info("Import progress: %d imported (%.0f/s)", stats.Imported, float64(stats.Imported)/time.Since(start).Seconds())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return stats, err
+	}
+
+	return stats, imp.writeCheckpoint(line)
+}
+
+// readCheckpoint returns the number of lines imported (according to the checkpoint), or 0 if there is none.
+func (imp *Importer) readCheckpoint() (int64, error) {
+	if imp.checkpoint == "" {
+		return 0, nil
+	}
+
+	data, err := ioutil.ReadFile(imp.checkpoint)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	done, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid checkpoint %s: %s", imp.checkpoint, err)
+	}
+	return done, nil
+}
+
+// writeCheckpoint (atomically) records the number of lines imported.
+func (imp *Importer) writeCheckpoint(done int64) error {
+	if imp.checkpoint == "" {
+		return nil
+	}
+
+	tmp := imp.checkpoint + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(done, 10)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, imp.checkpoint)
+}
@@ -0,0 +1,166 @@
+//go:build unit
+// +build unit
+
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"hash/fnv"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockRangeScanner is a RangeScanner of values whose token is the (FNV) hash of their key.
+type mockRangeScanner struct {
+	data map[string]Datum
+	err  error
+}
+
+func token(key string) int64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	return int64(hash.Sum64())
+}
+
+func (m *mockRangeScanner) ScanRange(start, end int64, fn func(string, Datum) error) error {
+	if m.err != nil {
+		return m.err
+	}
+	for key, datum := range m.data {
+		if t := token(key); t > start && t <= end {
+			if err := fn(key, datum); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestTokenRanges(t *testing.T) {
+	for _, n := range []int{1, 3, 256} {
+		ranges := tokenRanges(n)
+
+		AssertEquals(t, n, len(ranges), "Incorrect number of ranges")
+		AssertEquals(t, int64(math.MinInt64), ranges[0][0], "Incorrect start of first range")
+		AssertEquals(t, int64(math.MaxInt64), ranges[n-1][1], "Incorrect end of last range")
+
+		for i := 1; i < n; i++ {
+			AssertEquals(t, ranges[i-1][1], ranges[i][0], "Ranges not contiguous")
+			AssertEquals(t, true, ranges[i][0] < ranges[i][1], "Range empty, or wrapped")
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	logger, err := NewLogger(ioutil.Discard, "kask", "info")
+	if err != nil {
+		t.Fatalf("Unable to create Logger instance: %s", err)
+	}
+
+	// TTLs of 0 (never expires) to 99 minutes
+	source := &mockRangeScanner{data: make(map[string]Datum)}
+	for i := 0; i < 100; i++ {
+		source.data[RandString(8)] = Datum{[]byte(RandString(32)), i * 60}
+	}
+
+	var out bytes.Buffer
+	stats, err := Export(source, &out, 16, 4, logger)
+	if err != nil {
+		t.Fatalf("Unable to export: %s", err)
+	}
+	AssertEquals(t, int64(100), stats.Exported, "Incorrect number of records exported")
+	AssertEquals(t, 100, strings.Count(out.String(), "\n"), "Incorrect number of lines")
+
+	t.Run("Import", func(t *testing.T) {
+		dest := newMockStore()
+
+		stats, err := NewImporter(dest, 0, "", logger).Import(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatalf("Unable to import: %s", err)
+		}
+		AssertEquals(t, int64(100), stats.Imported, "Incorrect number of records imported")
+
+		for key, datum := range source.data {
+			AssertEquals(t, string(datum.Value), string(dest.data[key].Value), "Incorrect value")
+			// Allowing for a second to have passed since the export
+			if ttl := dest.data[key].TTL; ttl > datum.TTL || ttl < datum.TTL-1 {
+				t.Errorf("TTL not preserved; Expected: %d, was: %d", datum.TTL, ttl)
+			}
+		}
+	})
+
+	t.Run("Delayed", func(t *testing.T) {
+		dest := newMockStore()
+
+		// Imported 30 minutes after the export; The values of the first 30 minutes have expired since.
+		importer := NewImporter(dest, 0, "", logger)
+		importer.now = func() time.Time { return time.Now().Add(30 * time.Minute) }
+
+		stats, err := importer.Import(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatalf("Unable to import: %s", err)
+		}
+		AssertEquals(t, int64(30), stats.Expired, "Incorrect number of records expired")
+		AssertEquals(t, int64(70), stats.Imported, "Incorrect number of records imported")
+
+		for key, datum := range dest.data {
+			if expected := source.data[key].TTL; expected == 0 {
+				AssertEquals(t, 0, datum.TTL, "TTL of a value that never expires")
+			} else if datum.TTL > expected-1800 || datum.TTL < expected-1801 {
+				t.Errorf("TTL not reduced by the delay; Expected: %d, was: %d", expected-1800, datum.TTL)
+			}
+		}
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		checkpoint := writeTempFile(t, "60\n")
+		defer os.Remove(checkpoint)
+
+		dest := newMockStore()
+
+		stats, err := NewImporter(dest, 0, checkpoint, logger).Import(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatalf("Unable to import: %s", err)
+		}
+		AssertEquals(t, int64(60), stats.Skipped, "Incorrect number of records skipped")
+		AssertEquals(t, int64(40), stats.Imported, "Incorrect number of records imported")
+		AssertEquals(t, 40, len(dest.data), "Incorrect number of values stored")
+
+		data, _ := ioutil.ReadFile(checkpoint)
+		AssertEquals(t, "100\n", string(data), "Incorrect checkpoint")
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		if _, err := NewImporter(newMockStore(), 0, "", logger).Import(strings.NewReader("{\"key\": \"a\", \"value\": \"YQ==\"}\nnot json\n")); err == nil {
+			t.Errorf("Malformed record expected to fail!")
+		}
+	})
+
+	t.Run("Scan failure", func(t *testing.T) {
+		if _, err := Export(&mockRangeScanner{err: errors.New("timeout")}, ioutil.Discard, 16, 4, logger); err == nil {
+			t.Errorf("Failed scan expected to fail export!")
+		}
+	})
+}
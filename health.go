@@ -0,0 +1,76 @@
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthCheck verifies the health of a dependency (i.e. Cassandra).  Results are cached for a time, so that
+// frequent probes do not translate into frequent queries.
+type HealthCheck struct {
+	check   func(context.Context) error
+	timeout time.Duration
+	ttl     time.Duration
+	now     func() time.Time
+
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// NewHealthCheck returns a HealthCheck that invokes check with a deadline of timeout, caching the result for ttl.
+func NewHealthCheck(check func(context.Context) error, timeout, ttl time.Duration) *HealthCheck {
+	return &HealthCheck{check: check, timeout: timeout, ttl: ttl, now: time.Now}
+}
+
+// Err returns the result of the most recent check, performing a new one if the result has expired.
+func (h *HealthCheck) Err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.checked.IsZero() && h.now().Sub(h.checked) < h.ttl {
+		return h.err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	h.err = h.check(ctx)
+	h.checked = h.now()
+
+	return h.err
+}
+
+// HealthCheckMiddleware returns HTTP middleware that responds with a ServiceUnavailable problem (detailing the
+// failure) if the HealthCheck does not pass.
+func HealthCheckMiddleware(check *HealthCheck, logger *Logger, next http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := check.Err(); err != nil {
+			problem := ServiceUnavailable(r.URL.Path)
+			problem.Detail = err.Error()
+			HTTPError(w, problem)
+			logger.Warning("Readiness check failed: %s", err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
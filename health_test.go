@@ -0,0 +1,95 @@
+//go:build unit
+// +build unit
+
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	var calls int
+	var result error
+
+	check := NewHealthCheck(func(ctx context.Context) error {
+		calls++
+		if _, ok := ctx.Deadline(); !ok {
+			t.Errorf("Health check invoked without a deadline")
+		}
+		return result
+	}, time.Second, time.Minute)
+
+	now := time.Now()
+	check.now = func() time.Time { return now }
+
+	AssertEquals(t, nil, check.Err(), "Incorrect health check result")
+	AssertEquals(t, 1, calls, "Incorrect number of checks")
+
+	// Cached
+	result = errors.New("no connected Cassandra hosts")
+	AssertEquals(t, nil, check.Err(), "Incorrect (cached) health check result")
+	AssertEquals(t, 1, calls, "Incorrect number of checks")
+
+	// Expired
+	now = now.Add(time.Minute)
+	AssertEquals(t, result, check.Err(), "Incorrect health check result")
+	AssertEquals(t, 2, calls, "Incorrect number of checks")
+}
+
+func TestHealthCheckMiddleware(t *testing.T) {
+	logger, err := NewLogger(ioutil.Discard, "kask", "info")
+	if err != nil {
+		t.Fatalf("Unable to create Logger instance: %s", err)
+	}
+
+	t.Run("Healthy", func(t *testing.T) {
+		check := NewHealthCheck(func(context.Context) error { return nil }, time.Second, 0)
+		rr := httptest.NewRecorder()
+
+		HealthCheckMiddleware(check, logger, http.HandlerFunc(Healthz)).ServeHTTP(rr, httptest.NewRequest("GET", "/healthz/ready", nil))
+
+		AssertEquals(t, http.StatusOK, rr.Code, "Incorrect status code")
+	})
+
+	t.Run("Unhealthy", func(t *testing.T) {
+		check := NewHealthCheck(func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}, 10*time.Millisecond, 0)
+		rr := httptest.NewRecorder()
+
+		HealthCheckMiddleware(check, logger, http.HandlerFunc(Healthz)).ServeHTTP(rr, httptest.NewRequest("GET", "/healthz/ready", nil))
+
+		AssertEquals(t, http.StatusServiceUnavailable, rr.Code, "Incorrect status code")
+
+		var problem Problem
+		if err := json.Unmarshal(rr.Body.Bytes(), &problem); err != nil {
+			t.Fatalf("Unable to deserialize problem: %s", err)
+		}
+		AssertEquals(t, context.DeadlineExceeded.Error(), problem.Detail, "Incorrect problem detail")
+	})
+}
@@ -21,13 +21,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"path"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"text/template"
 	"time"
 
@@ -38,7 +41,16 @@ import (
 
 type contextKey int
 
-const kaskKey contextKey = iota
+const (
+	kaskKey contextKey = iota
+	kaskActionKey
+	identityKey
+)
+
+// Actions that may be addressed as a sub-resource of a key (i.e. {base_uri}{key}/{action}).
+const (
+	actionTouch = "touch"
+)
 
 // Problem corresponds to an HTTP problem (https://tools.ietf.org/html/rfc7807)
 type Problem struct {
@@ -71,6 +83,17 @@ func NotAuthorized(instance string) Problem {
 	}
 }
 
+// Forbidden is an HTTP problem (RFC7807) corresponding to a status 403 response.
+func Forbidden(instance string) Problem {
+	return Problem{
+		Code:     403,
+		Type:     "https://www.mediawiki.org/wiki/Kask/errors/forbidden",
+		Title:    "Forbidden",
+		Detail:   "You are not permitted to access this resource",
+		Instance: instance,
+	}
+}
+
 // NotFound is an HTTP problem (RFC7807) corresponding to a status 404 response.
 func NotFound(instance string) Problem {
 	return Problem{
@@ -82,6 +105,28 @@ func NotFound(instance string) Problem {
 	}
 }
 
+// PayloadTooLarge is an HTTP problem (RFC7807) corresponding to a status 413 response.
+func PayloadTooLarge(instance string) Problem {
+	return Problem{
+		Code:     413,
+		Type:     "https://www.mediawiki.org/wiki/Kask/errors/payload_too_large",
+		Title:    "Payload too large",
+		Detail:   "The value exceeds the maximum size permitted",
+		Instance: instance,
+	}
+}
+
+// UnsupportedMediaType is an HTTP problem (RFC7807) corresponding to a status 415 response.
+func UnsupportedMediaType(instance string) Problem {
+	return Problem{
+		Code:     415,
+		Type:     "https://www.mediawiki.org/wiki/Kask/errors/unsupported_media_type",
+		Title:    "Unsupported media type",
+		Detail:   "The content-coding of the request body is not supported",
+		Instance: instance,
+	}
+}
+
 // InternalServerError is an HTTP problem (RFC7807) corresponding to a status 500 response.
 func InternalServerError(instance string) Problem {
 	return Problem{
@@ -93,6 +138,41 @@ func InternalServerError(instance string) Problem {
 	}
 }
 
+// ServiceUnavailable is an HTTP problem (RFC7807) corresponding to a status 503 response.
+func ServiceUnavailable(instance string) Problem {
+	return Problem{
+		Code:     503,
+		Type:     "https://www.mediawiki.org/wiki/Kask/errors/service_unavailable",
+		Title:    "Service unavailable",
+		Detail:   "The service is not (or is no longer) ready to accept requests",
+		Instance: instance,
+	}
+}
+
+// ChecksumMismatch is an HTTP problem (RFC7807) corresponding to a status 500 response, for values that fail
+// integrity verification.
+func ChecksumMismatch(instance string) Problem {
+	return Problem{
+		Code:     500,
+		Type:     "https://www.mediawiki.org/wiki/Kask/errors/checksum_mismatch",
+		Title:    "Checksum mismatch",
+		Detail:   "The value stored is corrupt, and does not match its checksum",
+		Instance: instance,
+	}
+}
+
+// ReloadFailed is an HTTP problem (RFC7807) corresponding to a status 409 response, for configuration reloads
+// that are invalid, or that change settings requiring a restart.
+func ReloadFailed(instance string) Problem {
+	return Problem{
+		Code:     409,
+		Type:     "https://www.mediawiki.org/wiki/Kask/errors/reload_failed",
+		Title:    "Reload failed",
+		Detail:   "The configuration could not be reloaded",
+		Instance: instance,
+	}
+}
+
 // HTTPError applies an HTTP problem to an HTTP response
 func HTTPError(w http.ResponseWriter, p Problem) {
 	w.Header().Set("Content-Type", "application/json")
@@ -119,15 +199,52 @@ func getRequestID(r *http.Request) string {
 	return id
 }
 
-// HTTPHandler encapsulates the Kask request handlers and their dependencies.
+// HTTPHandler encapsulates the Kask request handlers (of a namespace) and their dependencies.
 type HTTPHandler struct {
-	store  Store
-	config *Config
-	log    *Logger
+	store     Store
+	config    *Config
+	namespace atomic.Pointer[Namespace]
+	log       *Logger
+}
+
+// NewHTTPHandler returns an HTTPHandler for a namespace.
+func NewHTTPHandler(store Store, config *Config, ns *Namespace, logger *Logger) *HTTPHandler {
+	handler := &HTTPHandler{store: store, config: config, log: logger}
+	handler.namespace.Store(ns)
+	return handler
+}
+
+// Namespace returns the (current) settings of the namespace.
+func (env *HTTPHandler) Namespace() *Namespace {
+	return env.namespace.Load()
+}
+
+// SetNamespace replaces the settings of the namespace (i.e. when the configuration is reloaded); Requests
+// in-flight complete with the settings they began with.
+func (env *HTTPHandler) SetNamespace(ns *Namespace) {
+	env.namespace.Store(ns)
 }
 
 // ServeHTTP accepts requests (of the base URI) for any HTTP method, and dispatches them to the appropriate handler.
 func (env *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Context().Value(kaskKey).(string)
+	if ns := env.Namespace(); ns.MaxKeySize > 0 && len(key) > ns.MaxKeySize {
+		HTTPError(w, BadRequest(r.URL.Path))
+		env.log.RequestID(getRequestID(r)).Log(LogError, "Key exceeds maximum size (%d > %d)", len(key), ns.MaxKeySize)
+		return
+	}
+
+	if action, ok := r.Context().Value(kaskActionKey).(string); ok {
+		switch {
+		case action == actionTouch && r.Method == http.MethodPost:
+			env.touch(w, r)
+		default:
+			HTTPError(w, BadRequest(r.URL.Path))
+			env.log.RequestID(getRequestID(r)).Log(LogError, "Unsupported HTTP method (%s) for %s", r.Method, action)
+		}
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
 		env.get(w, r)
@@ -146,33 +263,98 @@ func (env *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // GET requests
 func (env *HTTPHandler) get(w http.ResponseWriter, r *http.Request) {
 	key := r.Context().Value(kaskKey).(string)
-	value, err := env.store.Get(key)
+	value, encoding, err := env.read(w, r, key)
 	if err != nil {
-		if err == gocql.ErrNotFound {
-			HTTPError(w, NotFound(r.URL.Path))
-		} else {
-			HTTPError(w, InternalServerError(r.URL.Path))
-			env.log.RequestID(getRequestID(r)).Log(LogError, "Error reading from storage (%v)", err)
-		}
+		env.readError(w, r, key, err)
 		return
 	}
+
+	// Sliding expiration; Extend the lifetime of values read near the end of it (values with a TTL of 0 never expire).
+	// Touch rewrites the stored value as-is, and only if unchanged (a value deleted since read stays deleted).
+	if ns := env.Namespace(); ns.TouchOnRead && value.TTL > 0 && value.TTL < int(ns.TouchThreshold) {
+		if err := env.store.Touch(key, int(ns.DefaultTTL)); err != nil && err != gocql.ErrNotFound {
+			env.log.RequestID(getRequestID(r)).Log(LogWarning, "Error refreshing TTL in storage (%v)", err)
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/octet-stream")
 
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+
 	if _, err := w.Write(value.Value); err != nil {
 		env.log.RequestID(getRequestID(r)).Log(LogError, "Error writing HTTP response body: (%s)", err)
 	}
 }
 
+// readError applies the HTTP problem corresponding to an error reading a value from storage.
+func (env *HTTPHandler) readError(w http.ResponseWriter, r *http.Request, key string, err error) {
+	switch err {
+	case gocql.ErrNotFound:
+		HTTPError(w, NotFound(r.URL.Path))
+	case ErrChecksumMismatch:
+		HTTPError(w, ChecksumMismatch(r.URL.Path))
+		name := env.Namespace().Name
+		promChecksumMismatchCounterVec.WithLabelValues(name).Inc()
+		env.log.RequestID(getRequestID(r)).Log(LogError, "Value of key %q in namespace %s does not match checksum", key, name)
+	default:
+		HTTPError(w, InternalServerError(r.URL.Path))
+		env.log.RequestID(getRequestID(r)).Log(LogError, "Error reading from storage (%v)", err)
+	}
+}
+
+// read retrieves the value associated with a key.  If the store is able to return values compressed, and the
+// client accepts the encoding, then the value is returned as-is along with its content-coding.
+func (env *HTTPHandler) read(w http.ResponseWriter, r *http.Request, key string) (Datum, string, error) {
+	getter, ok := env.store.(CompressedGetter)
+	if !ok {
+		value, err := env.store.Get(key)
+		return value, "", err
+	}
+
+	// The representation now depends upon the request's Accept-Encoding
+	addVary(w.Header(), "Accept-Encoding")
+
+	if !acceptsEncoding(r, "zstd") {
+		value, err := env.store.Get(key)
+		return value, "", err
+	}
+
+	return getter.GetCompressed(key)
+}
+
 // POST requests
 func (env *HTTPHandler) post(w http.ResponseWriter, r *http.Request) {
 	key := r.Context().Value(kaskKey).(string)
-	body, err := ioutil.ReadAll(r.Body)
+	ns := env.Namespace()
+
+	var reader io.Reader = r.Body
+
+	// Read no more than one byte beyond the limit; Enough to know that it has been exceeded.
+	if ns.MaxValueSize > 0 {
+		reader = io.LimitReader(r.Body, int64(ns.MaxValueSize)+1)
+	}
+
+	body, err := ioutil.ReadAll(reader)
 	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			HTTPError(w, PayloadTooLarge(r.URL.Path))
+			env.log.RequestID(getRequestID(r)).Log(LogError, "Request body exceeds maximum size (%d)", tooLarge.Limit)
+			return
+		}
 		HTTPError(w, InternalServerError(r.URL.Path))
 		env.log.RequestID(getRequestID(r)).Log(LogDebug, "Error reading body of POST request: (%s)", err)
 		return
 	}
 
+	if ns.MaxValueSize > 0 && len(body) > ns.MaxValueSize {
+		HTTPError(w, PayloadTooLarge(r.URL.Path))
+		env.log.RequestID(getRequestID(r)).Log(LogError, "Request body exceeds maximum size (%d)", ns.MaxValueSize)
+		return
+	}
+
 	if len(body) == 0 {
 		HTTPError(w, BadRequest(r.URL.Path))
 		env.log.RequestID(getRequestID(r)).Log(LogError, "Request body is empty")
@@ -180,7 +362,7 @@ func (env *HTTPHandler) post(w http.ResponseWriter, r *http.Request) {
 	}
 
 	r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-	if err := env.store.Set(key, body, env.config.DefaultTTL); err != nil {
+	if err := env.store.Set(key, body, int(ns.DefaultTTL)); err != nil {
 		HTTPError(w, InternalServerError(r.URL.Path))
 		env.log.RequestID(getRequestID(r)).Log(LogError, "Error writing to storage (%v)", err)
 		return
@@ -204,13 +386,73 @@ func (env *HTTPHandler) delete(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// POST requests of the touch action; Resets the TTL of a value without resending it.
+func (env *HTTPHandler) touch(w http.ResponseWriter, r *http.Request) {
+	key := r.Context().Value(kaskKey).(string)
+	if err := env.store.Touch(key, int(env.Namespace().DefaultTTL)); err != nil {
+		env.readError(w, r, key, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// acceptsEncoding returns true if the Accept-Encoding header of a request includes coding (with a non-zero
+// qvalue).
+func acceptsEncoding(r *http.Request, coding string) bool {
+	return encodingQuality(r, coding) > 0
+}
+
+// encodingQuality returns the qvalue of coding in the Accept-Encoding header of a request, or 0 if it is not
+// listed (either by name, or by wildcard).
+func encodingQuality(r *http.Request, coding string) float64 {
+	wildcard := 0.0
+
+	for _, header := range r.Header["Accept-Encoding"] {
+		for _, element := range strings.Split(header, ",") {
+			params := strings.Split(element, ";")
+			name := strings.TrimSpace(params[0])
+			if !strings.EqualFold(name, coding) && name != "*" {
+				continue
+			}
+
+			q := 1.0
+			for _, param := range params[1:] {
+				if p := strings.TrimSpace(param); strings.HasPrefix(p, "q=") {
+					if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+						q = v
+					}
+				}
+			}
+
+			// A coding listed by name takes precedence over the wildcard.
+			if name != "*" {
+				return q
+			}
+			wildcard = q
+		}
+	}
+
+	return wildcard
+}
+
+// addVary adds a field to the Vary header of a response (unless already present).
+func addVary(header http.Header, field string) {
+	for _, value := range header["Vary"] {
+		for _, f := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), field) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", field)
+}
+
 // ValidatingKeyParserMiddleware returns HTTP middleware that parses a key from the remaining URI, and adds it to
-// the request context.
+// the request context.  A key may be followed by the name of an action (e.g. /{key}/touch), which is added to
+// the context as well.
 func ValidatingKeyParserMiddleware(baseURI string, next http.Handler) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		base := strings.Split(r.URL.Path, baseURI)[1:]
-
-		if len(base) == 0 {
+		if !strings.HasPrefix(r.URL.Path, baseURI) {
 			HTTPError(w, NotFound(r.URL.Path))
 			return
 		}
@@ -221,10 +463,10 @@ func ValidatingKeyParserMiddleware(baseURI string, next http.Handler) http.Handl
 			return
 		}
 
-		list := strings.Split(base[0], "/")
+		list := strings.Split(strings.TrimPrefix(r.URL.Path, baseURI), "/")
 
-		// Checks if there are more than one key passed in in the URL after the baseURI
-		if len(list) > 1 {
+		// Checks if there are more than one key (or a key and an unknown action) passed in the URL after the baseURI
+		if len(list) > 2 || (len(list) == 2 && list[1] != actionTouch) {
 			HTTPError(w, NotFound(r.URL.Path))
 			return
 		}
@@ -237,6 +479,11 @@ func ValidatingKeyParserMiddleware(baseURI string, next http.Handler) http.Handl
 		}
 
 		ctx := context.WithValue(r.Context(), kaskKey, key)
+
+		if len(list) == 2 {
+			ctx = context.WithValue(ctx, kaskActionKey, list[1])
+		}
+
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -269,8 +516,8 @@ func PrometheusInstrumentationMiddleware(counter *prometheus.CounterVec, obs *pr
 	})
 }
 
-// Healthz is an HTTP handler function that simply returns 200; Healthz serves as a
-// readiness test for Kubernetes.
+// Healthz is an HTTP handler function that simply returns 200 (along with build information); Healthz serves
+// as a liveness test for Kubernetes (wrap it with HealthCheckMiddleware for readiness).
 func Healthz(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -23,6 +23,7 @@ package main
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -35,24 +36,62 @@ import (
 	"text/template"
 
 	"github.com/gocql/gocql"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type mockStore struct {
-	data map[string][]byte
+	data map[string]Datum
 }
 
 func (m *mockStore) Set(key string, value []byte, ttl int) error {
-	m.data[key] = value
+	m.data[key] = Datum{value, ttl}
 	return nil
 }
 
 func (m *mockStore) Get(key string) (Datum, error) {
-	if value, ok := m.data[key]; ok {
-		return Datum{value, 0}, nil
+	if datum, ok := m.data[key]; ok {
+		return datum, nil
 	}
 	return Datum{nil, 0}, gocql.ErrNotFound
 }
 
+func (m *mockStore) Touch(key string, ttl int) error {
+	datum, ok := m.data[key]
+	if !ok {
+		return gocql.ErrNotFound
+	}
+	m.data[key] = Datum{datum.Value, ttl}
+	return nil
+}
+
+func (m *mockStore) ScanRange(start, end int64, fn func(string, Datum) error) error {
+	return (&mockRangeScanner{data: m.data}).ScanRange(start, end, fn)
+}
+
+func (m *mockStore) CompareAndSet(key string, old []byte, value []byte, ttl int) (bool, error) {
+	if datum, ok := m.data[key]; !ok || !bytes.Equal(datum.Value, old) {
+		return false, nil
+	}
+	m.data[key] = Datum{value, ttl}
+	return true, nil
+}
+
+func (m *mockStore) SetIfNotExists(key string, value []byte, ttl int) (bool, error) {
+	if _, ok := m.data[key]; ok {
+		return false, nil
+	}
+	m.data[key] = Datum{value, ttl}
+	return true, nil
+}
+
+func (m *mockStore) DeleteIf(key string, value []byte) (bool, error) {
+	if datum, ok := m.data[key]; !ok || !bytes.Equal(datum.Value, value) {
+		return false, nil
+	}
+	delete(m.data, key)
+	return true, nil
+}
+
 func (m *mockStore) Delete(key string) error {
 	delete(m.data, key)
 	return nil
@@ -63,26 +102,47 @@ func (m *mockStore) Close() {
 }
 
 func newMockStore() *mockStore {
-	return &mockStore{make(map[string][]byte)}
+	return &mockStore{make(map[string]Datum)}
+}
+
+// corruptStore is a mockStore whose values never match their checksum.
+type corruptStore struct {
+	*mockStore
+}
+
+func (m *corruptStore) Get(key string) (Datum, error) {
+	if _, err := m.mockStore.Get(key); err != nil {
+		return Datum{}, err
+	}
+	return Datum{}, ErrChecksumMismatch
+}
+
+func (m *corruptStore) Touch(key string, ttl int) error {
+	_, err := m.Get(key)
+	return err
 }
 
 const prefixURI = "/sessions/v1/"
 
 func setUp() (http.Handler, Store, error) {
+	return setUpWithConfig("default_ttl: 300000")
+}
+
+func setUpWithConfig(data string) (http.Handler, Store, error) {
 	var store Store
 	var config *Config
 	var logger *Logger
 	var err error
 
 	store = newMockStore()
-	if config, err = NewConfig([]byte("default_ttl: 300000")); err != nil {
+	if config, err = NewConfig([]byte(data)); err != nil {
 		return nil, nil, err
 	}
 	if logger, err = NewLogger(os.Stdout, config.ServiceName, config.LogLevel); err != nil {
 		return nil, nil, err
 	}
 
-	handler := &HTTPHandler{store, config, logger}
+	handler := NewHTTPHandler(store, config, &config.Namespaces[0], logger)
 	return ValidatingKeyParserMiddleware(prefixURI, handler), store, nil
 }
 
@@ -121,6 +181,41 @@ func TestGetNotFound(t *testing.T) {
 	AssertEquals(t, http.StatusNotFound, res.Code, "Incorrect status code")
 }
 
+func TestChecksumMismatch(t *testing.T) {
+	config, err := NewConfig([]byte{})
+	if err != nil {
+		t.Fatalf("Unable to create Config instance: %s", err)
+	}
+	logger, err := NewLogger(ioutil.Discard, config.ServiceName, config.LogLevel)
+	if err != nil {
+		t.Fatalf("Unable to create Logger instance: %s", err)
+	}
+
+	store := &corruptStore{newMockStore()}
+	store.Set("cat", []byte("meow"), 60)
+
+	handler := ValidatingKeyParserMiddleware(prefixURI, NewHTTPHandler(store, config, &config.Namespaces[0], logger))
+	counter := promChecksumMismatchCounterVec.WithLabelValues(config.Namespaces[0].Name)
+
+	for _, tc := range []struct{ method, uri string }{{"GET", "cat"}, {"POST", "cat/touch"}} {
+		t.Run(tc.method, func(t *testing.T) {
+			before := testutil.ToFloat64(counter)
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest(tc.method, path.Join(prefixURI, tc.uri), nil))
+
+			AssertEquals(t, http.StatusInternalServerError, rr.Code, "Incorrect status code")
+
+			var problem Problem
+			if err := json.Unmarshal(rr.Body.Bytes(), &problem); err != nil {
+				t.Fatalf("Unable to deserialize problem: %s", err)
+			}
+			AssertEquals(t, ChecksumMismatch("").Type, problem.Type, "Incorrect problem type")
+			AssertEquals(t, before+1, testutil.ToFloat64(counter), "Mismatch not counted")
+		})
+	}
+}
+
 func TestPost(t *testing.T) {
 	handler, store := setUpTesting(t)
 
@@ -183,6 +278,165 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestSizeLimits(t *testing.T) {
+	handler, store, err := setUpWithConfig(`
+namespaces:
+  - name: limited
+    base_uri: /sessions/v1
+    table: sessions
+    max_key_size: 8
+    max_value_size: 4
+`)
+	if err != nil {
+		t.Fatalf("Error encountered in test setup: %s", err)
+	}
+
+	t.Run("Key too large", func(t *testing.T) {
+		req := httptest.NewRequest("GET", path.Join(prefixURI, "abcdefghi"), nil)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		AssertEquals(t, http.StatusBadRequest, res.Code, "Incorrect status code")
+	})
+
+	t.Run("Value too large", func(t *testing.T) {
+		req := httptest.NewRequest("POST", path.Join(prefixURI, "cat"), strings.NewReader("meows"))
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		AssertEquals(t, http.StatusRequestEntityTooLarge, res.Code, "Incorrect status code")
+
+		if _, err := store.Get("cat"); err != gocql.ErrNotFound {
+			t.Errorf("Oversized value was stored")
+		}
+	})
+
+	t.Run("Within limits", func(t *testing.T) {
+		req := httptest.NewRequest("POST", path.Join(prefixURI, "abcdefgh"), strings.NewReader("meow"))
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		AssertEquals(t, http.StatusCreated, res.Code, "Incorrect status code")
+	})
+}
+
+func TestTouch(t *testing.T) {
+	handler, store := setUpTesting(t)
+
+	store.Set("cat", []byte("meow"), 10)
+
+	t.Run("204 POST", func(t *testing.T) {
+		req := httptest.NewRequest("POST", path.Join(prefixURI, "cat", "touch"), nil)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+
+		AssertEquals(t, http.StatusNoContent, res.Code, "Incorrect status code")
+
+		value, _ := store.Get("cat")
+		AssertEquals(t, 300000, value.TTL, "TTL not reset")
+		AssertEquals(t, "meow", string(value.Value), "Value altered")
+	})
+
+	t.Run("404 POST", func(t *testing.T) {
+		req := httptest.NewRequest("POST", path.Join(prefixURI, "dog", "touch"), nil)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+
+		AssertEquals(t, http.StatusNotFound, res.Code, "Incorrect status code")
+	})
+
+	t.Run("400 GET", func(t *testing.T) {
+		req := httptest.NewRequest("GET", path.Join(prefixURI, "cat", "touch"), nil)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+
+		AssertEquals(t, http.StatusBadRequest, res.Code, "Incorrect status code")
+	})
+}
+
+// racingStore is a mockStore that invokes a function after each read (i.e. to delete a key between the read and
+// write of a touch).
+type racingStore struct {
+	*mockStore
+	afterGet func(string)
+}
+
+func (m *racingStore) Get(key string) (Datum, error) {
+	datum, err := m.mockStore.Get(key)
+	if m.afterGet != nil {
+		m.afterGet(key)
+	}
+	return datum, err
+}
+
+func TestTouchDeleted(t *testing.T) {
+	store := &racingStore{mockStore: newMockStore()}
+	store.Set("cat", []byte("meow"), 10)
+
+	// The key is deleted (once) after touch reads it
+	store.afterGet = func(key string) {
+		store.afterGet = nil
+		store.Delete(key)
+	}
+
+	if err := touch(store, "cat", 300); err != gocql.ErrNotFound {
+		t.Errorf("Expected gocql.ErrNotFound, got: %v", err)
+	}
+	if _, err := store.Get("cat"); err != gocql.ErrNotFound {
+		t.Errorf("Deleted key resurrected by touch")
+	}
+
+	// A key overwritten after touch reads it keeps the value (and TTL) written
+	store.Set("dog", []byte("woof"), 10)
+	store.afterGet = func(key string) {
+		store.afterGet = nil
+		store.Set(key, []byte("arf"), 20)
+	}
+
+	if err := touch(store, "dog", 300); err != nil {
+		t.Errorf("Error touching value: %s", err)
+	}
+	datum, _ := store.Get("dog")
+	AssertEquals(t, "arf", string(datum.Value), "Overwritten value altered")
+	AssertEquals(t, 20, datum.TTL, "Overwritten TTL altered")
+}
+
+func TestTouchOnRead(t *testing.T) {
+	handler, store, err := setUpWithConfig(`
+namespaces:
+  - name: sessions
+    base_uri: /sessions/v1
+    table: sessions
+    default_ttl: 3600
+    touch_on_read: true
+    touch_threshold: 600
+`)
+	if err != nil {
+		t.Fatalf("Error encountered in test setup: %s", err)
+	}
+
+	testCases := []struct {
+		key      string
+		ttl      int
+		expected int
+	}{
+		{"fresh", 1200, 1200},
+		{"stale", 300, 3600},
+		{"eternal", 0, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.key, func(t *testing.T) {
+			store.Set(tc.key, []byte("meow"), tc.ttl)
+
+			req := httptest.NewRequest("GET", path.Join(prefixURI, tc.key), nil)
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+
+			AssertEquals(t, http.StatusOK, res.Code, "Incorrect status code")
+
+			value, _ := store.Get(tc.key)
+			AssertEquals(t, tc.expected, value.TTL, "Incorrect TTL after read")
+		})
+	}
+}
+
 func TestValidatingKeyParserMiddleware(t *testing.T) {
 	testCases := []struct {
 		url        string
@@ -191,6 +445,8 @@ func TestValidatingKeyParserMiddleware(t *testing.T) {
 	}{
 		{path.Join(prefixURI, "cat"), "cat", 200},
 		{path.Join(prefixURI, "cat/dog"), "", 404},
+		{path.Join(prefixURI, "cat/touch"), "cat", 200},
+		{path.Join(prefixURI, "cat/touch/dog"), "", 404},
 		{prefixURI, "", 404},
 		{"/something/else", "", 404},
 		{path.Join(prefixURI, "foo%3Fbar"), "foo?bar", 200},
@@ -220,6 +476,40 @@ func TestValidatingKeyParserMiddleware(t *testing.T) {
 
 }
 
+func TestRootBaseURI(t *testing.T) {
+	config, err := NewConfig([]byte("base_uri: /\ndefault_ttl: 300"))
+	if err != nil {
+		t.Fatalf("Unable to create Config instance: %s", err)
+	}
+	logger, err := NewLogger(ioutil.Discard, config.ServiceName, config.LogLevel)
+	if err != nil {
+		t.Fatalf("Unable to create Logger instance: %s", err)
+	}
+
+	store := newMockStore()
+	handler := ValidatingKeyParserMiddleware("/", NewHTTPHandler(store, config, &config.Namespaces[0], logger))
+
+	serve := func(method, url string) int {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest(method, url, strings.NewReader("meow")))
+		return res.Code
+	}
+
+	store.Set("cat", []byte("meow"), 10)
+
+	AssertEquals(t, http.StatusOK, serve("GET", "/cat"), "Incorrect status code")
+	AssertEquals(t, http.StatusNoContent, serve("POST", "/cat/touch"), "Incorrect status code")
+	AssertEquals(t, 300, store.data["cat"].TTL, "TTL not reset")
+	AssertEquals(t, http.StatusNotFound, serve("POST", "/dog/touch"), "Incorrect status code")
+	if _, ok := store.data["dog"]; ok {
+		t.Errorf("Touch of a missing key stored it")
+	}
+	AssertEquals(t, http.StatusBadRequest, serve("DELETE", "/cat/touch"), "Incorrect status code")
+	AssertEquals(t, "meow", string(store.data["cat"].Value), "Value deleted")
+	AssertEquals(t, http.StatusNotFound, serve("GET", "/cat/dog/bird"), "Incorrect status code")
+	AssertEquals(t, http.StatusNotFound, serve("GET", "/"), "Incorrect status code")
+}
+
 func TestHealthz(t *testing.T) {
 	handler := http.HandlerFunc(Healthz)
 	rr := httptest.NewRecorder()
@@ -18,38 +18,77 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/gocql/gocql"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	yaml "gopkg.in/yaml.v2"
 )
 
 var (
-	confFile = flag.String("config", "/etc/kask/config.yaml", "Path to the configuration file")
+	confFile    = flag.String("config", "/etc/kask/config.yaml", "Path to the configuration file")
+	printConfig = flag.Bool("print-config", false, "Print the effective configuration (with secrets redacted), and exit")
 
 	promHTTPReqsCounterVec = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "http_requests_total",
-			Help: "Count of HTTP requests processed, partitioned by status code and HTTP method.",
+			Help: "Count of HTTP requests processed, partitioned by status code, HTTP method, and namespace.",
 		},
-		[]string{"code", "method"},
+		[]string{"code", "method", "namespace"},
 	)
 
 	promDurationHistoVec = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "http_request_duration_seconds",
-			Help:    "A histogram of latencies for requests, partitioned by status code and HTTP method.",
+			Help:    "A histogram of latencies for requests, partitioned by status code, HTTP method, and namespace.",
 			Buckets: []float64{.001, .0025, .0050, .01, .025, .050, .10, .25, .50, 1},
 		},
-		[]string{"code", "method"},
+		[]string{"code", "method", "namespace"},
 	)
 
+	promCompressionRatioHistoVec = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "kask_compression_ratio",
+			Help:    "A histogram of the ratio of compressed to uncompressed size of stored values, partitioned by namespace.",
+			Buckets: []float64{.1, .2, .3, .4, .5, .6, .7, .8, .9, 1},
+		},
+		[]string{"namespace"},
+	)
+
+	promChecksumMismatchCounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kask_checksum_mismatches_total",
+			Help: "Count of values read from storage that did not match their checksum, partitioned by namespace.",
+		},
+		[]string{"namespace"},
+	)
+
+	promMigrationReadsCounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kask_migration_reads_total",
+			Help: "Count of reads of migrating namespaces, partitioned by namespace, and result (new, old, or miss).",
+		},
+		[]string{"namespace", "result"},
+	)
+
+	promCertificateExpiryGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "kask_tls_certificate_expiry_timestamp_seconds",
+			Help: "The expiry (as a Unix timestamp) of the TLS certificate currently served.",
+		})
+
 	// These values are passed in at build time using -ldflags
 	version   = "unknown"
 	buildHost = "unknown"
@@ -64,19 +103,45 @@ var (
 )
 
 func init() {
-	prometheus.MustRegister(promHTTPReqsCounterVec, promDurationHistoVec, promBuildInfoGauge)
+	prometheus.MustRegister(promHTTPReqsCounterVec, promDurationHistoVec, promCompressionRatioHistoVec, promChecksumMismatchCounterVec, promMigrationReadsCounterVec, promCertificateExpiryGauge, promBuildInfoGauge)
 	promBuildInfoGauge.Set(1)
 }
 
+// Reloader is implemented by those things (i.e. certificates, secrets, and keyrings) that can be re-read from
+// the file system at runtime.
+type Reloader interface {
+	Reload() error
+}
+
 func main() {
 	flag.Parse()
 
+	// Commands that verify the configuration are executed before (and instead of) loading it.
+	if flag.Arg(0) == "config" {
+		os.Exit(configCommand(*confFile, flag.Args()[1:], os.Stdout))
+	}
+
 	config, err := ReadConfig(*confFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	logger, err := NewLogger(os.Stdout, config.ServiceName, config.LogLevel)
+	if *printConfig {
+		out, err := yaml.Marshal(config.Redacted())
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Print(string(out))
+		return
+	}
+
+	// Subcommands log to stderr, leaving stdout for their output (i.e. of get, or export).
+	logOutput := os.Stdout
+	if flag.NArg() > 0 {
+		logOutput = os.Stderr
+	}
+
+	logger, err := NewLogger(logOutput, config.ServiceName, config.LogLevel)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -84,48 +149,338 @@ func main() {
 	log.SetFlags(0)
 	log.SetOutput(logger)
 
+	// Execute a subcommand (if any), instead of starting the service.
+	if flag.NArg() > 0 {
+		if err := runCommand(config, logger, flag.Args()); err != nil {
+			logger.Fatal("%s", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	logger.Info("Initializing Kask %s (Go version: %s, Build host: %s, Timestamp: %s)...", version, runtime.Version(), buildHost, buildDate)
 
 	logger.Debug("Cassandra host(s): %s", strings.Join(config.Cassandra.Hosts, ", "))
 	logger.Debug("Cassandra port: %d", config.Cassandra.Port)
 	logger.Debug("Cassandra keyspace: %s", config.Cassandra.Keyspace)
-	logger.Debug("Cassandra table: %s", config.Cassandra.Table)
 	logger.Debug("Cassandra connect timeout: %dms", config.Cassandra.ConnectTimeout)
 	logger.Debug("Cassandra query timeout: %dms", config.Cassandra.QueryTimeout)
 
-	store, err := NewCassandraStore(config)
+	session, err := createSession(config)
 	if err != nil {
 		logger.Fatal("Error connecting to Cassandra: %s", err)
 		os.Exit(1)
 	}
 
 	// Close the database connection before returning from main()
-	defer store.Close()
+	defer session.Close()
+
+	oldSession, err := createMigrationSession(config)
+	if err != nil {
+		logger.Fatal("Error connecting to the Cassandra cluster being migrated from: %s", err)
+		os.Exit(1)
+	}
+	if oldSession != nil {
+		defer oldSession.Close()
+	}
 
-	// Kask CRUD operations
-	handler := &HTTPHandler{store, config, logger}
+	authenticators, err := NewAuthenticators(config)
+	if err != nil {
+		logger.Fatal("Error initializing authentication: %s", err)
+		os.Exit(1)
+	}
 
-	// Wrap in middlewares
-	dispatcher := ValidatingKeyParserMiddleware(config.BaseURI, handler)
-	dispatcher = PrometheusInstrumentationMiddleware(promHTTPReqsCounterVec, promDurationHistoVec, dispatcher)
+	var keyring *Keyring
+	if config.Encryption.Keyring != "" {
+		if keyring, err = ReadKeyring(config.Encryption.Keyring); err != nil {
+			logger.Fatal("Error reading encryption keyring: %s", err)
+			os.Exit(1)
+		}
+		logger.Info("Encrypting values with key %q", keyring.Primary())
+	}
 
-	http.Handle(config.BaseURI, dispatcher)
-	http.Handle("/metrics", promhttp.Handler())
-	http.Handle("/healthz", http.HandlerFunc(Healthz))
+	allowedClients := map[string][]string{
+		opRead:   config.TLS.AllowedClients.Read,
+		opWrite:  config.TLS.AllowedClients.Write,
+		opDelete: config.TLS.AllowedClients.Delete,
+	}
 
-	// Serve OpenAPI specification (if so-configured).
-	if config.OpenAPISpec != "" {
-		http.Handle("/openapi", OpenAPI(config, logger))
+	// The key-value API is served by the data listener, and operational endpoints (metrics, health, etc) by the
+	// admin listener (if configured; Otherwise, by the data listener as well).
+	mux := http.NewServeMux()
+	adminMux := mux
+	if config.Admin.Port != 0 {
+		adminMux = http.NewServeMux()
+	}
+
+	handlers := make(map[string]*HTTPHandler)
+	for i := range config.Namespaces {
+		ns := &config.Namespaces[i]
+
+		logger.Debug("Namespace %s: base URI: %s, table: %s.%s, default TTL: %ds", ns.Name, ns.BaseURI, ns.Keyspace, ns.Table, ns.DefaultTTL)
+
+		store, err := newStore(config, session, oldSession, ns, keyring, logger)
+		if err != nil {
+			logger.Fatal("Error initializing storage for namespace %s: %s", ns.Name, err)
+			os.Exit(1)
+		}
+
+		// Kask CRUD operations
+		handler := NewHTTPHandler(store, config, ns, logger)
+		handlers[ns.Name] = handler
+
+		// Wrap in middlewares
+		var next http.Handler = handler
+		if len(config.Authorization) > 0 {
+			next = AuthorizationMiddleware(authorizationRules(config, ns.Name), logger, next)
+		}
+
+		labels := prometheus.Labels{"namespace": ns.Name}
+		dispatcher := ValidatingKeyParserMiddleware(ns.BaseURI, next)
+		if len(authenticators) > 0 {
+			dispatcher = AuthenticationMiddleware(authenticators, logger, dispatcher)
+		}
+		if config.TLS.ClientCAPath != "" {
+			dispatcher = ClientCertificateMiddleware(allowedClients, logger, dispatcher)
+		}
+		if config.HTTPCompression.Enabled {
+			dispatcher = CompressionMiddleware(config.HTTPCompression.MinSize, logger, dispatcher)
+		}
+		dispatcher = PrometheusInstrumentationMiddleware(promHTTPReqsCounterVec.MustCurryWith(labels), promDurationHistoVec.MustCurryWith(labels).(*prometheus.HistogramVec), dispatcher)
+
+		mux.Handle(ns.BaseURI, dispatcher)
 	}
 
 	listen := fmt.Sprintf("%s:%d", config.Address, config.Port)
 
-	// TLS configuration
+	// TLS configuration; Certificates are reloaded when changed, or upon SIGHUP (see below).
+	var tlsConfig *tls.Config
+	var certificates *CertificateReloader
 	if config.TLS.CertPath != "" {
-		logger.Info("Starting service as https://%s%s", listen, config.BaseURI)
-		log.Fatal(http.ListenAndServeTLS(listen, config.TLS.CertPath, config.TLS.KeyPath, nil))
-	} else {
-		logger.Info("Starting service as http://%s%s", listen, config.BaseURI)
-		log.Fatal(http.ListenAndServe(listen, nil))
+		if tlsConfig, err = NewTLSConfig(config); err != nil {
+			logger.Fatal("Error initializing TLS: %s", err)
+			os.Exit(1)
+		}
+		if certificates, err = NewCertificateReloader(config.TLS.CertPath, config.TLS.KeyPath, logger, promCertificateExpiryGauge); err != nil {
+			logger.Fatal("Error loading TLS certificate: %s", err)
+			os.Exit(1)
+		}
+		tlsConfig.GetCertificate = certificates.GetCertificate
+
+		if config.TLS.ReloadInterval > 0 {
+			go certificates.Watch(time.Duration(config.TLS.ReloadInterval)*time.Second, nil)
+		}
 	}
+
+	// Certificates, secrets, and keyrings read from files are re-read upon SIGHUP, as is the configuration (of
+	// which changes to some settings are applied; See ConfigReloader).
+	configuration := NewConfigReloader(*confFile, config, logger, handlers)
+	reloaders := map[string]Reloader{"configuration": configuration}
+	if certificates != nil {
+		reloaders["TLS certificate"] = certificates
+	}
+	for _, auth := range authenticators {
+		switch a := auth.(type) {
+		case *TokenAuthenticator:
+			reloaders["authentication tokens"] = a
+		case *HMACAuthenticator:
+			if a.filename != "" {
+				reloaders["HMAC secret"] = a
+			}
+		}
+	}
+	if keyring != nil {
+		reloaders["encryption keyring"] = keyring
+	}
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			logger.Info("Received SIGHUP; Reloading...")
+			for name, reloader := range reloaders {
+				if err := reloader.Reload(); err != nil {
+					logger.Error("Error reloading %s (retaining the current one): %s", name, err)
+				}
+			}
+		}
+	}()
+
+	server := NewServer(listen, config.HTTPServer, tlsConfig, mux, logger)
+	if !config.TLS.HTTP2 {
+		server.DisableHTTP2()
+	}
+	if config.HTTPServer.H2C {
+		if err := server.EnableH2C(); err != nil {
+			logger.Fatal("Unable to enable h2c: %s", err)
+			os.Exit(1)
+		}
+	}
+
+	adminMux.Handle("/metrics", promhttp.Handler())
+	adminMux.Handle("/healthz/live", http.HandlerFunc(Healthz))
+
+	// Readiness; /healthz (which predates /healthz/ready) is the same check, so that probes of it do not route to a
+	// kask that cannot reach Cassandra.
+	cassandraCheck := NewHealthCheck(
+		pingCassandra(session),
+		time.Duration(config.Healthz.Timeout)*time.Millisecond,
+		time.Duration(config.Healthz.CacheTTL)*time.Millisecond)
+	ready := server.ReadinessMiddleware(HealthCheckMiddleware(cassandraCheck, logger, http.HandlerFunc(Healthz)))
+	adminMux.Handle("/healthz", ready)
+	adminMux.Handle("/healthz/ready", ready)
+
+	// The configuration can be reloaded on demand, but only via the (internal-only) admin listener.
+	if config.Admin.Port != 0 {
+		adminMux.Handle("/reload", configuration)
+	}
+
+	// Serve OpenAPI specification (if so-configured).
+	if config.OpenAPISpec != "" {
+		adminMux.Handle("/openapi", OpenAPI(config, logger))
+	}
+
+	errc := make(chan error, 3)
+
+	// A listen port of 0 disables the TCP listener (leaving only a Unix domain socket).
+	if config.Port != 0 {
+		go func() {
+			errc <- server.ListenAndServe("", "")
+		}()
+
+		if tlsConfig != nil {
+			logger.Info("Starting service as https://%s", listen)
+		} else {
+			logger.Info("Starting service as http://%s", listen)
+		}
+	}
+
+	if config.Socket.Path != "" {
+		mode, _ := strconv.ParseUint(config.Socket.Mode, 8, 32)
+		go func() {
+			errc <- server.ListenAndServeUnix(config.Socket.Path, os.FileMode(mode))
+		}()
+
+		logger.Info("Starting service on unix:%s", config.Socket.Path)
+	}
+
+	var admin *Server
+	if config.Admin.Port != 0 {
+		adminListen := fmt.Sprintf("%s:%d", config.Admin.Address, config.Admin.Port)
+
+		// The admin listener uses the server certificate and TLS parameters (if so-configured), but does not
+		// verify clients.
+		var adminTLSConfig *tls.Config
+		if config.Admin.TLS {
+			adminTLSConfig = NewAdminTLSConfig(config)
+			adminTLSConfig.GetCertificate = certificates.GetCertificate
+		}
+
+		admin = NewServer(adminListen, config.HTTPServer, adminTLSConfig, adminMux, logger)
+		if !config.TLS.HTTP2 {
+			admin.DisableHTTP2()
+		}
+		if config.HTTPServer.H2C {
+			if err := admin.EnableH2C(); err != nil {
+				logger.Fatal("Unable to enable h2c (admin): %s", err)
+				os.Exit(1)
+			}
+		}
+		go func() {
+			errc <- admin.ListenAndServe("", "")
+		}()
+
+		if adminTLSConfig != nil {
+			logger.Info("Starting admin service as https://%s", adminListen)
+		} else {
+			logger.Info("Starting admin service as http://%s", adminListen)
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	select {
+	case err := <-errc:
+		logger.Fatal("Error serving requests: %s", err)
+		os.Exit(1)
+	case sig := <-signals:
+		logger.Info("Received %s; Shutting down...", sig)
+	}
+
+	stats, err := server.Shutdown(time.Duration(config.Shutdown.DrainPeriod)*time.Second, time.Duration(config.Shutdown.Timeout)*time.Second)
+	if err != nil {
+		logger.Error("Error shutting down: %s", err)
+	}
+
+	logger.Info(
+		"Shutdown complete in %s: %d request(s) in-flight at start, %d completed while draining, %d abandoned",
+		stats.Duration.Round(time.Millisecond),
+		stats.InFlight,
+		stats.Drained,
+		stats.Abandoned)
+
+	// The admin listener remains available (reporting not-ready) until the data listener has shut down.
+	if admin != nil {
+		if _, err := admin.Shutdown(0, time.Duration(config.Shutdown.Timeout)*time.Second); err != nil {
+			logger.Error("Error shutting down admin listener: %s", err)
+		}
+	}
+}
+
+// authorizationRules returns the authorization rules that apply to the named namespace.
+func authorizationRules(config *Config, namespace string) []AuthorizationRule {
+	var rules []AuthorizationRule
+	for _, rule := range config.Authorization {
+		if rule.AppliesTo(namespace) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// newStore returns the Store of a namespace; Cassandra storage (migrating from another table or cluster, if
+// so-configured), with values encrypted (if keyring is non-nil), and compressed (if so-configured).  The oldSession
+// is that of the cluster being migrated from, or nil if the same as session.
+func newStore(config *Config, session, oldSession *gocql.Session, ns *Namespace, keyring *Keyring, logger *Logger) (Store, error) {
+	var store Store
+
+	cassandra, err := NewCassandraStore(session, ns)
+	if err != nil {
+		return nil, err
+	}
+	store = cassandra
+
+	// Values are migrated as stored (i.e. encrypted, and compressed), so the old table must be configured alike.
+	if keyspace, table, ok := config.MigrationSource(ns); ok {
+		if oldSession == nil {
+			oldSession = session
+		}
+
+		oldNs := *ns
+		oldNs.Keyspace, oldNs.Table = keyspace, table
+
+		old, err := NewCassandraStore(oldSession, &oldNs)
+		if err != nil {
+			return nil, fmt.Errorf("migration: %s", err)
+		}
+
+		logger.Info("Namespace %s: migrating from %s.%s", ns.Name, keyspace, table)
+
+		reads := promMigrationReadsCounterVec.MustCurryWith(prometheus.Labels{"namespace": ns.Name})
+		store = NewMigratingStore(old, cassandra, config.Migration.CopyForward, reads, logger)
+	}
+
+	if keyring != nil {
+		store = NewEncryptingStore(store, keyring)
+	}
+
+	// Compression must precede encryption (ciphertext does not compress).
+	if ns.Compression.Algorithm != "" {
+		if store, err = NewCompressingStore(store, ns.Compression.MinSize, ns.MaxValueSize, promCompressionRatioHistoVec.WithLabelValues(ns.Name)); err != nil {
+			return nil, fmt.Errorf("compression: %s", err)
+		}
+	}
+
+	return store, nil
 }
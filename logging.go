@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -38,7 +39,7 @@ const (
 type Logger struct {
 	writer      io.Writer
 	serviceName string
-	logLevel    int
+	logLevel    int32
 }
 
 // LogMessage represents JSON serializable log messages.
@@ -87,7 +88,7 @@ func (l *Logger) log(level int, msg func() LogMessage) {
 	}
 
 	// Skip if level is below what we're configured to log.
-	if level < l.logLevel {
+	if int32(level) < atomic.LoadInt32(&l.logLevel) {
 		return
 	}
 
@@ -133,7 +134,7 @@ func (l *Logger) Debug(format string, v ...interface{}) {
 // Write logs messages of severity WARNING.  This method satisfies the io.Writer
 // interface so that Logger instances can be used as output for Golang's log module.
 func (l *Logger) Write(bytes []byte) (int, error) {
-	l.log(LogWarning, l.basicLogMessage(LogWarning, strings.TrimSuffix(string(bytes), "\n")))
+	l.log(LogWarning, l.basicLogMessage(LogWarning, "%s", strings.TrimSuffix(string(bytes), "\n")))
 	return len(bytes), nil
 }
 
@@ -183,22 +184,39 @@ func LevelString(level int) string {
 
 // NewLogger creates a new instance of Logger
 func NewLogger(writer io.Writer, serviceName string, logLevel string) (*Logger, error) {
-	var level int
+	level, err := parseLevel(logLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Logger{writer, serviceName, int32(level)}, nil
+}
 
+// SetLevel changes the level of the Logger (i.e. when the configuration is reloaded).
+func (l *Logger) SetLevel(logLevel string) error {
+	level, err := parseLevel(logLevel)
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&l.logLevel, int32(level))
+	return nil
+}
+
+// parseLevel returns the level corresponding to its (case-insensitive) name.
+func parseLevel(logLevel string) (int, error) {
 	switch strings.ToUpper(logLevel) {
 	case LevelString(LogDebug):
-		level = LogDebug
+		return LogDebug, nil
 	case LevelString(LogInfo):
-		level = LogInfo
+		return LogInfo, nil
 	case LevelString(LogWarning):
-		level = LogWarning
+		return LogWarning, nil
 	case LevelString(LogError):
-		level = LogError
+		return LogError, nil
 	case LevelString(LogFatal):
-		level = LogFatal
+		return LogFatal, nil
 	default:
-		return nil, fmt.Errorf("Unsupported log level: %s", logLevel)
+		return 0, fmt.Errorf("Unsupported log level: %s", logLevel)
 	}
-
-	return &Logger{writer, serviceName, level}, nil
 }
@@ -99,6 +99,19 @@ func TestLogger(t *testing.T) {
 		AssertEquals(t, 0, len(writer.data), "Unexpected log output")
 	})
 
+	t.Run("SetLevel", func(t *testing.T) {
+		writer, logger := setUp(LogInfo)
+		if err := logger.SetLevel("debug"); err != nil {
+			t.Fatalf("Unable to set log level: %s", err)
+		}
+		logger.Debug("Noisy log message")
+		AssertEquals(t, true, len(writer.data) > 0, "Missing log output")
+
+		if err := logger.SetLevel("verbose"); err == nil {
+			t.Errorf("Unsupported log level expected to fail!")
+		}
+	})
+
 	t.Run("Scoped", func(t *testing.T) {
 		writer, logger := setUp(LogInfo)
 		logger.RequestID("0000000a-000a-000a-000a-00000000000a").Log(LogWarning, "Consider yourself %s", "warned")
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"github.com/gocql/gocql"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Migration read results (see MigratingStore).
+const (
+	migrationReadNew  = "new"
+	migrationReadOld  = "old"
+	migrationReadMiss = "miss"
+)
+
+// MigrationTarget is implemented by Stores that values can be migrated (copied forward) to.
+type MigrationTarget interface {
+	Store
+	// SetIfNotExists stores a value for a key, only if there is none; Returns true if the value was stored.
+	SetIfNotExists(key string, value []byte, ttl int) (bool, error)
+	// DeleteIf removes the value of a key, only if it is value; Returns true if the value was removed.
+	DeleteIf(key string, value []byte) (bool, error)
+}
+
+// MigratingStore is a Store for the live migration of values from one backend to another (i.e. between tables, or
+// clusters).  Writes (and deletes) are made to both, and values are read from the new, falling back to the old
+// when not found; Once every value has been written to the new (or has expired from the old), the old can be
+// retired.
+type MigratingStore struct {
+	old         Store
+	new         MigrationTarget
+	copyForward bool
+	reads       *prometheus.CounterVec
+	logger      *Logger
+}
+
+// NewMigratingStore returns a MigratingStore that migrates values from old to new.  If copyForward is true, values
+// found only in the old are copied to the new (with their remaining TTL) when read.  Reads are counted in reads,
+// by result (one of "new", "old", or "miss").
+func NewMigratingStore(old Store, new MigrationTarget, copyForward bool, reads *prometheus.CounterVec, logger *Logger) *MigratingStore {
+	return &MigratingStore{old, new, copyForward, reads, logger}
+}
+
+// Set stores a value in the new, and the old backends.
+func (s *MigratingStore) Set(key string, value []byte, ttl int) error {
+	if err := s.new.Set(key, value, ttl); err != nil {
+		return err
+	}
+	return s.old.Set(key, value, ttl)
+}
+
+// Get retrieves a value from the new backend, or from the old if not found there.
+func (s *MigratingStore) Get(key string) (Datum, error) {
+	datum, err := s.new.Get(key)
+	if err != gocql.ErrNotFound {
+		if err == nil {
+			s.reads.WithLabelValues(migrationReadNew).Inc()
+		}
+		return datum, err
+	}
+
+	if datum, err = s.old.Get(key); err != nil {
+		if err == gocql.ErrNotFound {
+			s.reads.WithLabelValues(migrationReadMiss).Inc()
+		}
+		return datum, err
+	}
+
+	s.reads.WithLabelValues(migrationReadOld).Inc()
+
+	// A value that cannot be copied is still returned; It will be copied (or retried) on a subsequent read.
+	if s.copyForward {
+		if err := s.copy(key, datum.Value, datum.TTL); err != nil && err != gocql.ErrNotFound {
+			s.logger.Warning("Unable to copy key %q to the new backend: %s", key, err)
+		}
+	}
+
+	return datum, nil
+}
+
+// copy copies a value read from the old backend to the new, without racing concurrent writes or deletes; The
+// value is written only if the new has none (a concurrent Set wins), and is removed again if the old no longer
+// has it (a concurrent Delete wins), in which case gocql.ErrNotFound is returned.  This relies upon Delete
+// removing values from the old backend before the new.
+func (s *MigratingStore) copy(key string, value []byte, ttl int) error {
+	applied, err := s.new.SetIfNotExists(key, value, ttl)
+	if err != nil || !applied {
+		return err
+	}
+
+	if _, err = s.old.Get(key); err == gocql.ErrNotFound {
+		if _, err := s.new.DeleteIf(key, value); err != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+// Touch resets the TTL of a value in both backends; A value found only in the old is copied to the new (if
+// copyForward is true), with the new TTL.
+func (s *MigratingStore) Touch(key string, ttl int) error {
+	err := s.new.Touch(key, ttl)
+	if err == nil {
+		if err := s.old.Touch(key, ttl); err != nil && err != gocql.ErrNotFound {
+			return err
+		}
+		return nil
+	}
+	if err != gocql.ErrNotFound {
+		return err
+	}
+
+	if !s.copyForward {
+		return s.old.Touch(key, ttl)
+	}
+
+	datum, err := s.old.Get(key)
+	if err != nil {
+		return err
+	}
+	if err := s.old.Touch(key, ttl); err != nil {
+		return err
+	}
+	return s.copy(key, datum.Value, ttl)
+}
+
+// Delete removes a value from the old, and the new backends (in that order; See copy).
+func (s *MigratingStore) Delete(key string) error {
+	if err := s.old.Delete(key); err != nil {
+		return err
+	}
+	return s.new.Delete(key)
+}
+
+// Close closes both the new, and the old backends.
+func (s *MigratingStore) Close() {
+	s.new.Close()
+	s.old.Close()
+}
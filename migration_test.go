@@ -0,0 +1,200 @@
+//go:build unit
+// +build unit
+
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/gocql/gocql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// failingStore is a mockStore whose writes fail.
+type failingStore struct {
+	*mockStore
+}
+
+func (m *failingStore) Set(key string, value []byte, ttl int) error {
+	return errors.New("write failed")
+}
+
+func newTestMigratingStore(t *testing.T, old Store, new MigrationTarget, copyForward bool) (*MigratingStore, *prometheus.CounterVec) {
+	logger, err := NewLogger(ioutil.Discard, "kask", "info")
+	if err != nil {
+		t.Fatalf("Unable to create logger: %s", err)
+	}
+	reads := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "migration_reads"}, []string{"result"})
+	return NewMigratingStore(old, new, copyForward, reads, logger), reads
+}
+
+func TestMigratingStoreWrites(t *testing.T) {
+	old, new := newMockStore(), newMockStore()
+	store, _ := newTestMigratingStore(t, old, new, false)
+
+	if err := store.Set("key", []byte("value"), 60); err != nil {
+		t.Fatalf("Unable to set value: %s", err)
+	}
+	AssertEquals(t, "value", string(old.data["key"].Value), "Value not written to old")
+	AssertEquals(t, "value", string(new.data["key"].Value), "Value not written to new")
+
+	if err := store.Touch("key", 120); err != nil {
+		t.Fatalf("Unable to touch value: %s", err)
+	}
+	AssertEquals(t, 120, old.data["key"].TTL, "Old value not touched")
+	AssertEquals(t, 120, new.data["key"].TTL, "New value not touched")
+
+	if err := store.Delete("key"); err != nil {
+		t.Fatalf("Unable to delete value: %s", err)
+	}
+	AssertEquals(t, 0, len(old.data), "Value not deleted from old")
+	AssertEquals(t, 0, len(new.data), "Value not deleted from new")
+
+	// A failed write to the new backend is not made to the old
+	store, _ = newTestMigratingStore(t, old, &failingStore{newMockStore()}, false)
+	if err := store.Set("key", []byte("value"), 60); err == nil {
+		t.Errorf("Expected an error writing to a failing store")
+	}
+	AssertEquals(t, 0, len(old.data), "Value written to old")
+}
+
+func TestMigratingStoreReads(t *testing.T) {
+	testCases := []struct {
+		name        string
+		copyForward bool
+	}{
+		{"Without copy forward", false},
+		{"With copy forward", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			old, new := newMockStore(), newMockStore()
+			store, reads := newTestMigratingStore(t, old, new, tc.copyForward)
+
+			old.data["migrated"] = Datum{[]byte("old value"), 30}
+			new.data["migrated"] = Datum{[]byte("new value"), 60}
+			old.data["unmigrated"] = Datum{[]byte("old value"), 30}
+
+			datum, err := store.Get("migrated")
+			if err != nil {
+				t.Fatalf("Unable to get value: %s", err)
+			}
+			AssertEquals(t, "new value", string(datum.Value), "Unexpected value")
+
+			datum, err = store.Get("unmigrated")
+			if err != nil {
+				t.Fatalf("Unable to get value: %s", err)
+			}
+			AssertEquals(t, "old value", string(datum.Value), "Unexpected value")
+			AssertEquals(t, 30, datum.TTL, "Unexpected TTL")
+
+			_, copied := new.data["unmigrated"]
+			AssertEquals(t, tc.copyForward, copied, "Unexpected copy forward")
+			if copied {
+				AssertEquals(t, 30, new.data["unmigrated"].TTL, "Remaining TTL not copied forward")
+			}
+
+			if _, err := store.Get("missing"); err != gocql.ErrNotFound {
+				t.Errorf("Expected gocql.ErrNotFound, got: %v", err)
+			}
+
+			AssertEquals(t, float64(1), testutil.ToFloat64(reads.WithLabelValues(migrationReadNew)), "Unexpected new reads")
+			AssertEquals(t, float64(1), testutil.ToFloat64(reads.WithLabelValues(migrationReadOld)), "Unexpected old reads")
+			AssertEquals(t, float64(1), testutil.ToFloat64(reads.WithLabelValues(migrationReadMiss)), "Unexpected misses")
+		})
+	}
+}
+
+func TestMigratingStoreCopyRacingDelete(t *testing.T) {
+	testCases := []struct {
+		name  string
+		touch bool
+		// The read (of the old backend) after which the key is deleted
+		after int
+	}{
+		{"Get, deleted before copy", false, 1},
+		{"Get, deleted after copy", false, 2},
+		{"Touch, deleted before copy", true, 1},
+		{"Touch, deleted after copy", true, 2},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			old, new := &racingStore{mockStore: newMockStore()}, newMockStore()
+			store, _ := newTestMigratingStore(t, old, new, true)
+
+			old.data["key"] = Datum{[]byte("old value"), 30}
+
+			reads := 0
+			old.afterGet = func(key string) {
+				if reads++; reads == tc.after {
+					store.Delete(key)
+				}
+			}
+
+			if tc.touch {
+				store.Touch("key", 120)
+			} else {
+				store.Get("key")
+			}
+
+			_, inOld := old.data["key"]
+			_, inNew := new.data["key"]
+			AssertEquals(t, false, inOld, "Deleted key in old")
+			AssertEquals(t, false, inNew, "Deleted key copied forward")
+		})
+	}
+}
+
+func TestMigratingStoreTouch(t *testing.T) {
+	testCases := []struct {
+		name        string
+		copyForward bool
+	}{
+		{"Without copy forward", false},
+		{"With copy forward", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			old, new := newMockStore(), newMockStore()
+			store, _ := newTestMigratingStore(t, old, new, tc.copyForward)
+
+			old.data["unmigrated"] = Datum{[]byte("old value"), 30}
+
+			if err := store.Touch("unmigrated", 120); err != nil {
+				t.Fatalf("Unable to touch value: %s", err)
+			}
+			AssertEquals(t, 120, old.data["unmigrated"].TTL, "Old value not touched")
+
+			_, copied := new.data["unmigrated"]
+			AssertEquals(t, tc.copyForward, copied, "Unexpected copy forward")
+			if copied {
+				AssertEquals(t, "old value", string(new.data["unmigrated"].Value), "Unexpected value copied forward")
+				AssertEquals(t, 120, new.data["unmigrated"].TTL, "Unexpected TTL copied forward")
+			}
+
+			if err := store.Touch("missing", 120); err != gocql.ErrNotFound {
+				t.Errorf("Expected gocql.ErrNotFound, got: %v", err)
+			}
+		})
+	}
+}
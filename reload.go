@@ -0,0 +1,121 @@
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ConfigReloader re-reads the configuration file, and applies changes to those settings that can be changed
+// without a restart (see ConfigChange.Reloadable); The log level, and the TTL, size limits, and sliding expiration
+// of each namespace.  Should any other setting have changed, the reload is refused (and nothing is applied).
+type ConfigReloader struct {
+	filename string
+	logger   *Logger
+	// Handlers by namespace name
+	handlers map[string]*HTTPHandler
+
+	mu      sync.Mutex
+	current *Config
+}
+
+// NewConfigReloader returns a ConfigReloader for the configuration file (of which current is the contents), that
+// applies changes to the logger and handlers.
+func NewConfigReloader(filename string, current *Config, logger *Logger, handlers map[string]*HTTPHandler) *ConfigReloader {
+	return &ConfigReloader{filename: filename, logger: logger, handlers: handlers, current: current}
+}
+
+// Reload re-reads the configuration file, and applies any changes.
+func (r *ConfigReloader) Reload() error {
+	_, err := r.reload()
+	return err
+}
+
+// reload re-reads the configuration file, applies the changes, and returns them.
+func (r *ConfigReloader) reload() ([]ConfigChange, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	config, err := ReadConfig(r.filename)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := DiffConfig(r.current, config)
+
+	var restart []string
+	for _, change := range changes {
+		if !change.Reloadable() {
+			restart = append(restart, change.Path)
+		}
+	}
+	if len(restart) > 0 {
+		return nil, fmt.Errorf("a restart is required to change %s (no changes applied)", strings.Join(restart, ", "))
+	}
+
+	if err := r.logger.SetLevel(config.LogLevel); err != nil {
+		return nil, err
+	}
+
+	for i := range config.Namespaces {
+		if handler, ok := r.handlers[config.Namespaces[i].Name]; ok {
+			handler.SetNamespace(&config.Namespaces[i])
+		}
+	}
+
+	for _, change := range changes {
+		r.logger.Info("Configuration changed: %s: %s -> %s", change.Path, change.Old, change.New)
+	}
+	if len(changes) == 0 {
+		r.logger.Info("Configuration unchanged")
+	}
+
+	r.current = config
+
+	return changes, nil
+}
+
+// ServeHTTP reloads the configuration upon a POST, and responds with the (JSON serialized) changes applied.
+func (r *ConfigReloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		HTTPError(w, BadRequest(req.URL.Path))
+		return
+	}
+
+	changes, err := r.reload()
+	if err != nil {
+		problem := ReloadFailed(req.URL.Path)
+		problem.Detail = err.Error()
+		HTTPError(w, problem)
+		r.logger.Error("Error reloading configuration: %s", err)
+		return
+	}
+
+	if changes == nil {
+		changes = []ConfigChange{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Changes []ConfigChange `json:"changes"`
+	}{changes})
+}
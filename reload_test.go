@@ -0,0 +1,105 @@
+//go:build unit
+// +build unit
+
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// writeReloadConfig (re)writes a configuration file with a namespace, returning the Config it contains.
+func writeReloadConfig(t *testing.T, filename, logLevel string, port, ttl int) *Config {
+	data := fmt.Sprintf("log_level: %s\nlisten_port: %d\nnamespaces:\n  - name: sessions\n    base_uri: /sessions/v1\n    table: sessions\n    default_ttl: %d\n", logLevel, port, ttl)
+	if err := ioutil.WriteFile(filename, []byte(data), 0600); err != nil {
+		t.Fatalf("Unable to write configuration file: %s", err)
+	}
+	config, err := NewConfig([]byte(data))
+	if err != nil {
+		t.Fatalf("Failed to read configuration data: %v", err)
+	}
+	return config
+}
+
+func TestConfigReloader(t *testing.T) {
+	filename := writeTempFile(t, "")
+	defer os.Remove(filename)
+
+	config := writeReloadConfig(t, filename, "info", 8080, 3600)
+
+	logger, err := NewLogger(ioutil.Discard, "kask", config.LogLevel)
+	if err != nil {
+		t.Fatalf("Unable to create Logger instance: %s", err)
+	}
+
+	handler := NewHTTPHandler(nil, config, &config.Namespaces[0], logger)
+	reloader := NewConfigReloader(filename, config, logger, map[string]*HTTPHandler{"sessions": handler})
+
+	t.Run("Reloadable", func(t *testing.T) {
+		writeReloadConfig(t, filename, "debug", 8080, 60)
+
+		rr := httptest.NewRecorder()
+		reloader.ServeHTTP(rr, httptest.NewRequest("POST", "/reload", nil))
+		AssertEquals(t, http.StatusOK, rr.Code, "Incorrect status code")
+
+		var res struct {
+			Changes []ConfigChange `json:"changes"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+			t.Fatalf("Unable to deserialize response: %s", err)
+		}
+		AssertEquals(t, 2, len(res.Changes), "Incorrect number of changes")
+		AssertEquals(t, ConfigChange{"log_level", "info", "debug"}, res.Changes[0], "Incorrect change")
+		AssertEquals(t, ConfigChange{"namespaces[0].default_ttl", "3600", "60"}, res.Changes[1], "Incorrect change")
+
+		AssertEquals(t, Seconds(60), handler.Namespace().DefaultTTL, "Namespace TTL not applied")
+		AssertEquals(t, int32(LogDebug), logger.logLevel, "Log level not applied")
+	})
+
+	t.Run("Restart required", func(t *testing.T) {
+		writeReloadConfig(t, filename, "error", 8081, 120)
+
+		if err := reloader.Reload(); err == nil {
+			t.Fatalf("Change of listen port expected to fail reload!")
+		}
+
+		// Nothing is applied
+		AssertEquals(t, Seconds(60), handler.Namespace().DefaultTTL, "Namespace TTL applied")
+		AssertEquals(t, int32(LogDebug), logger.logLevel, "Log level applied")
+
+		rr := httptest.NewRecorder()
+		reloader.ServeHTTP(rr, httptest.NewRequest("POST", "/reload", nil))
+		AssertEquals(t, http.StatusConflict, rr.Code, "Incorrect status code")
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		if err := ioutil.WriteFile(filename, []byte("default_ttl: -1"), 0600); err != nil {
+			t.Fatalf("Unable to write configuration file: %s", err)
+		}
+		if err := reloader.Reload(); err == nil {
+			t.Errorf("Invalid configuration expected to fail reload!")
+		}
+	})
+}
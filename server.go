@@ -0,0 +1,293 @@
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Server is an HTTP server that can be shut down gracefully; It tracks the requests in-flight, and reports
+// itself not-ready (see ReadinessMiddleware) once shutdown begins.
+type Server struct {
+	server         *http.Server
+	logger         *Logger
+	maxConnections int
+	draining       int32
+	active         int64
+	drained        int64
+}
+
+// ShutdownStats summarizes a (graceful) shutdown.
+type ShutdownStats struct {
+	// Requests in-flight when shutdown began
+	InFlight int64
+	// Requests completed after shutdown began
+	Drained int64
+	// Requests still in-flight when the shutdown timeout expired
+	Abandoned int64
+	Duration  time.Duration
+}
+
+// NewServer returns a Server listening on addr, with the timeouts and limits of settings, and with TLS (if
+// tlsConfig is non-nil).
+func NewServer(addr string, settings HTTPServerConfig, tlsConfig *tls.Config, handler http.Handler, logger *Logger) *Server {
+	s := &Server{logger: logger, maxConnections: settings.MaxConnections}
+	s.server = &http.Server{
+		Addr:              addr,
+		TLSConfig:         tlsConfig,
+		Handler:           s.track(handler),
+		ReadTimeout:       time.Duration(settings.ReadTimeout) * time.Millisecond,
+		ReadHeaderTimeout: time.Duration(settings.ReadHeaderTimeout) * time.Millisecond,
+		WriteTimeout:      time.Duration(settings.WriteTimeout) * time.Millisecond,
+		IdleTimeout:       time.Duration(settings.IdleTimeout) * time.Millisecond,
+		MaxHeaderBytes:    settings.MaxHeaderBytes,
+	}
+	return s
+}
+
+// DisableHTTP2 disables the negotiation of HTTP/2 (over TLS), leaving only HTTP/1.1.
+func (s *Server) DisableHTTP2() {
+	s.server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+}
+
+// EnableH2C enables cleartext HTTP/2 (h2c, with prior knowledge, or by upgrade) on connections without TLS.  The
+// HTTP/2 server is configured for the Server's shutdown, to gracefully close (hijacked) h2c connections as well.
+func (s *Server) EnableH2C() error {
+	h2s := &http2.Server{IdleTimeout: s.server.IdleTimeout}
+
+	// Configuring h2s creates a TLS configuration where there was none (which must not enable TLS), and enables
+	// HTTP/2 over TLS (which must remain disabled, if it was; See DisableHTTP2).
+	tlsConfig, disabled := s.server.TLSConfig, s.server.TLSNextProto != nil
+	if disabled {
+		s.server.TLSConfig = nil
+	}
+	err := http2.ConfigureServer(s.server, h2s)
+	s.server.TLSConfig = tlsConfig
+	if disabled {
+		s.server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	if err != nil {
+		return err
+	}
+
+	s.server.Handler = h2c.NewHandler(s.server.Handler, h2s)
+	return nil
+}
+
+// track wraps a handler, counting the requests in-flight (and those completed once draining).
+func (s *Server) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&s.active, 1)
+		defer func() {
+			atomic.AddInt64(&s.active, -1)
+			if s.Draining() {
+				atomic.AddInt64(&s.drained, 1)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ListenAndServe listens on the TCP address of the Server, and serves requests until it is shut down; The
+// certificate and key files are used if TLS is configured (and may be empty if the TLS configuration supplies
+// certificates).  Unlike http.Server, shutdown is not an error.
+func (s *Server) ListenAndServe(certFile, keyFile string) error {
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener, certFile, keyFile)
+}
+
+// ListenAndServeUnix listens on a Unix domain socket (created with mode), and serves requests (without TLS) until
+// the Server is shut down.  A socket left behind (i.e. by an unclean exit) is replaced, but any other file at path
+// is an error.
+func (s *Server) ListenAndServeUnix(path string, mode os.FileMode) error {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s exists, and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return err
+	}
+
+	return s.serve(listener, false, "", "")
+}
+
+// Serve accepts connections on listener, and serves requests until the Server is shut down.
+func (s *Server) Serve(listener net.Listener, certFile, keyFile string) error {
+	return s.serve(listener, s.server.TLSConfig != nil, certFile, keyFile)
+}
+
+func (s *Server) serve(listener net.Listener, useTLS bool, certFile, keyFile string) error {
+	if s.maxConnections > 0 {
+		listener = newLimitListener(listener, s.maxConnections)
+	}
+
+	var err error
+	if useTLS {
+		err = s.server.ServeTLS(listener, certFile, keyFile)
+	} else {
+		err = s.server.Serve(listener)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Draining returns true once shutdown has begun.
+func (s *Server) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// Shutdown gracefully shuts the Server down.  Once begun, the Server reports itself not-ready, and continues
+// serving requests for the drain period (giving load-balancers time to stop routing to it).  It then stops
+// accepting connections, and waits (up to timeout) for requests in-flight to complete, before closing any that
+// remain.
+func (s *Server) Shutdown(drainPeriod, timeout time.Duration) (ShutdownStats, error) {
+	start := time.Now()
+	stats := ShutdownStats{InFlight: atomic.LoadInt64(&s.active)}
+
+	atomic.StoreInt32(&s.draining, 1)
+
+	// Encourage clients to reconnect (elsewhere) as their current requests complete.
+	s.server.SetKeepAlivesEnabled(false)
+
+	s.logger.Info("Draining connections for %s (%d request(s) in-flight)", drainPeriod, stats.InFlight)
+	time.Sleep(drainPeriod)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := s.server.Shutdown(ctx)
+	if err == nil {
+		err = s.wait(ctx)
+	}
+	if err == context.DeadlineExceeded {
+		stats.Abandoned = atomic.LoadInt64(&s.active)
+		err = s.server.Close()
+	}
+
+	stats.Drained = atomic.LoadInt64(&s.drained)
+	stats.Duration = time.Since(start)
+
+	return stats, err
+}
+
+// wait waits until no requests remain in-flight, or ctx is done; http.Server.Shutdown does not wait for the
+// requests of hijacked (i.e. h2c) connections.
+func (s *Server) wait(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&s.active) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// ReadinessMiddleware returns HTTP middleware that responds with a ServiceUnavailable problem once the Server
+// has begun shutting down.
+func (s *Server) ReadinessMiddleware(next http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Draining() {
+			HTTPError(w, ServiceUnavailable(r.URL.Path))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitListener is a net.Listener that accepts at most n simultaneous connections; Once at the limit, Accept
+// blocks until a connection is closed (leaving further connections to queue in the kernel's backlog).
+type limitListener struct {
+	net.Listener
+	sem   chan struct{}
+	done  chan struct{}
+	close sync.Once
+}
+
+func newLimitListener(listener net.Listener, n int) *limitListener {
+	return &limitListener{Listener: listener, sem: make(chan struct{}, n), done: make(chan struct{})}
+}
+
+// Accept waits for a connection slot, and then for a connection.
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+
+	return &limitConn{Conn: conn, release: func() { <-l.sem }}, nil
+}
+
+// Close closes the listener (unblocking any Accept waiting on a connection slot).
+func (l *limitListener) Close() error {
+	l.close.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// limitConn is a net.Conn that releases its slot (of a limitListener) when closed.
+type limitConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+// Close closes the connection, and releases its slot.
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
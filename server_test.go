@@ -0,0 +1,378 @@
+//go:build unit
+// +build unit
+
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// startServer returns a Server (and its base URL) serving handler on a random port of the loopback interface.
+func startServer(t *testing.T, settings HTTPServerConfig, handler http.Handler) (*Server, string) {
+	logger, err := NewLogger(ioutil.Discard, "kask", "info")
+	if err != nil {
+		t.Fatalf("Unable to create Logger instance: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+
+	server := NewServer(listener.Addr().String(), settings, nil, handler, logger)
+	go server.Serve(listener, "", "")
+
+	return server, fmt.Sprintf("http://%s", listener.Addr())
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	started := make(chan bool)
+	release := make(chan bool)
+
+	server, url := startServer(t, HTTPServerConfig{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+	}))
+
+	result := make(chan int)
+	go func() {
+		res, err := http.Get(url)
+		if err != nil {
+			result <- 0
+			return
+		}
+		res.Body.Close()
+		result <- res.StatusCode
+	}()
+	<-started
+
+	done := make(chan ShutdownStats)
+	go func() {
+		stats, err := server.Shutdown(100*time.Millisecond, time.Second)
+		if err != nil {
+			t.Errorf("Error shutting down: %s", err)
+		}
+		done <- stats
+	}()
+
+	// While draining, readiness checks fail.
+	time.Sleep(10 * time.Millisecond)
+	rr := httptest.NewRecorder()
+	server.ReadinessMiddleware(http.HandlerFunc(Healthz)).ServeHTTP(rr, httptest.NewRequest("GET", "/healthz", nil))
+	AssertEquals(t, http.StatusServiceUnavailable, rr.Code, "Incorrect readiness status code")
+
+	release <- true
+
+	AssertEquals(t, http.StatusOK, <-result, "In-flight request not completed")
+
+	stats := <-done
+	AssertEquals(t, int64(1), stats.InFlight, "Incorrect in-flight count")
+	AssertEquals(t, int64(1), stats.Drained, "Incorrect drained count")
+	AssertEquals(t, int64(0), stats.Abandoned, "Incorrect abandoned count")
+}
+
+func TestGracefulShutdownH2C(t *testing.T) {
+	started := make(chan bool)
+	release := make(chan bool)
+
+	logger, err := NewLogger(ioutil.Discard, "kask", "info")
+	if err != nil {
+		t.Fatalf("Unable to create Logger instance: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+
+	server := NewServer(listener.Addr().String(), HTTPServerConfig{}, nil, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+	}), logger)
+	if err := server.EnableH2C(); err != nil {
+		t.Fatalf("Unable to enable h2c: %s", err)
+	}
+	go server.Serve(listener, "", "")
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+
+	result := make(chan int)
+	go func() {
+		res, err := client.Get(fmt.Sprintf("http://%s", listener.Addr()))
+		if err != nil {
+			result <- 0
+			return
+		}
+		res.Body.Close()
+		result <- res.ProtoMajor
+	}()
+	<-started
+
+	done := make(chan ShutdownStats)
+	go func() {
+		stats, err := server.Shutdown(0, time.Second)
+		if err != nil {
+			t.Errorf("Error shutting down: %s", err)
+		}
+		done <- stats
+	}()
+
+	// Shutdown waits for the request in-flight (on a hijacked connection)
+	select {
+	case <-done:
+		t.Fatalf("Shutdown completed with an h2c request in-flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	release <- true
+
+	AssertEquals(t, 2, <-result, "In-flight h2c request not completed")
+
+	stats := <-done
+	AssertEquals(t, int64(1), stats.InFlight, "Incorrect in-flight count")
+	AssertEquals(t, int64(1), stats.Drained, "Incorrect drained count")
+	AssertEquals(t, int64(0), stats.Abandoned, "Incorrect abandoned count")
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	started := make(chan bool)
+	release := make(chan bool)
+	defer close(release)
+
+	server, url := startServer(t, HTTPServerConfig{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+	}))
+
+	go http.Get(url)
+	<-started
+
+	stats, _ := server.Shutdown(0, 50*time.Millisecond)
+
+	AssertEquals(t, int64(1), stats.Abandoned, "Incorrect abandoned count")
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	server, url := startServer(t, HTTPServerConfig{ReadHeaderTimeout: 50}, http.HandlerFunc(Healthz))
+	defer server.Shutdown(0, time.Second)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	defer conn.Close()
+
+	// A (slowloris) client that never completes its request header is disconnected.
+	fmt.Fprintf(conn, "GET /healthz HTTP/1.1\r\nHost: localhost\r\n")
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Errorf("Connection not closed by server: %s", err)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	server, url := startServer(t, HTTPServerConfig{MaxConnections: 1}, http.HandlerFunc(Healthz))
+	defer server.Shutdown(0, time.Second)
+
+	addr := strings.TrimPrefix(url, "http://")
+
+	// Occupy the only connection slot
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Unable to connect: %s", err)
+	}
+	defer second.Close()
+
+	fmt.Fprintf(second, "GET /healthz HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+
+	// Not served while the first connection remains open...
+	buf := make([]byte, 12)
+	second.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := second.Read(buf); err == nil {
+		t.Fatalf("Connection beyond the limit served!")
+	}
+
+	// ...but served once it closes.
+	first.Close()
+
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(second, buf); err != nil {
+		t.Fatalf("Unable to read response: %s", err)
+	}
+	AssertEquals(t, "HTTP/1.1 200", string(buf), "Incorrect response")
+}
+
+func TestProtocols(t *testing.T) {
+	logger, err := NewLogger(ioutil.Discard, "kask", "info")
+	if err != nil {
+		t.Fatalf("Unable to create Logger instance: %s", err)
+	}
+
+	certFile, keyFile := generateCertificate(t, "localhost", time.Now().Add(time.Hour))
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+
+	// An HTTP/2 (with prior knowledge) client of cleartext connections
+	h2c := &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+
+	testCases := []struct {
+		name      string
+		tls       bool
+		http2     bool
+		h2c       bool
+		transport http.RoundTripper
+		major     int
+	}{
+		{"TLS w/ HTTP/2", true, true, false, &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, ForceAttemptHTTP2: true}, 2},
+		{"TLS w/o HTTP/2", true, false, false, &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, ForceAttemptHTTP2: true}, 1},
+		{"Cleartext", false, true, false, &http.Transport{}, 1},
+		{"h2c", false, true, true, h2c, 2},
+		{"TLS w/ HTTP/2, and h2c", true, true, true, &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, ForceAttemptHTTP2: true}, 2},
+		{"TLS w/o HTTP/2, and h2c", true, false, true, &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, ForceAttemptHTTP2: true}, 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Unable to listen: %s", err)
+			}
+
+			var tlsConfig *tls.Config
+			scheme := "http"
+			if tc.tls {
+				tlsConfig, scheme = &tls.Config{}, "https"
+			}
+
+			server := NewServer(listener.Addr().String(), HTTPServerConfig{}, tlsConfig, http.HandlerFunc(Healthz), logger)
+			if !tc.http2 {
+				server.DisableHTTP2()
+			}
+			if tc.h2c {
+				if err := server.EnableH2C(); err != nil {
+					t.Fatalf("Unable to enable h2c: %s", err)
+				}
+			}
+			go server.Serve(listener, certFile, keyFile)
+			defer server.Shutdown(0, time.Second)
+
+			client := &http.Client{Transport: tc.transport}
+			res, err := client.Get(fmt.Sprintf("%s://%s/healthz", scheme, listener.Addr()))
+			if err != nil {
+				t.Fatalf("Request failed: %s", err)
+			}
+			res.Body.Close()
+
+			AssertEquals(t, tc.major, res.ProtoMajor, "Incorrect protocol")
+		})
+	}
+}
+
+func TestListenAndServeUnix(t *testing.T) {
+	logger, err := NewLogger(ioutil.Discard, "kask", "info")
+	if err != nil {
+		t.Fatalf("Unable to create Logger instance: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "kask")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := path.Join(dir, "kask.sock")
+
+	server := NewServer("", HTTPServerConfig{}, nil, http.HandlerFunc(Healthz), logger)
+
+	// Files other than sockets are not replaced
+	if err := ioutil.WriteFile(socket, nil, 0600); err != nil {
+		t.Fatalf("Unable to write file: %s", err)
+	}
+	if err := server.ListenAndServeUnix(socket, 0660); err == nil {
+		t.Fatalf("Expected an error replacing a regular file")
+	}
+	os.Remove(socket)
+
+	// A stale socket is replaced
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	go server.ListenAndServeUnix(socket, 0660)
+	defer server.Shutdown(0, time.Second)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+
+	var res *http.Response
+	for i := 0; i < 50; i++ {
+		if res, err = client.Get("http://kask/healthz"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	res.Body.Close()
+
+	AssertEquals(t, http.StatusOK, res.StatusCode, "Incorrect status code")
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatalf("Unable to stat socket: %s", err)
+	}
+	AssertEquals(t, os.FileMode(0660), info.Mode().Perm(), "Incorrect socket mode")
+}
@@ -18,7 +18,13 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"strings"
 	"time"
 
 	"github.com/gocql/gocql"
@@ -31,14 +37,31 @@ type Store interface {
 	Set(string, []byte, int) error
 	Get(string) (Datum, error)
 	Delete(string) error
+	Touch(string, int) error
 	Close()
 }
 
 // CassandraStore provides access to storage using Apache Cassandra.
 type CassandraStore struct {
-	session  *gocql.Session
-	Keyspace string
-	Table    string
+	session           *gocql.Session
+	Keyspace          string
+	Table             string
+	ReadConsistency   gocql.Consistency
+	WriteConsistency  gocql.Consistency
+	DeleteConsistency gocql.Consistency
+	Checksums         bool
+}
+
+// ErrChecksumMismatch is returned when a value read from storage does not match its checksum.
+var ErrChecksumMismatch = errors.New("value does not match checksum")
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum returns the CRC32C of a value (as 4 bytes, big-endian).
+func checksum(value []byte) []byte {
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.Checksum(value, crc32c))
+	return sum
 }
 
 // Datum represents a value returned from storage.
@@ -82,7 +105,13 @@ func createSession(config *Config) (*gocql.Session, error) {
 	// Authentication
 	authConf := cassandra.Authentication
 
-	if authConf.Username != "" {
+	if authConf.PasswordFile != "" {
+		// Verify the file is readable now, rather than upon the first connection.
+		if _, err := readSecretFile(authConf.PasswordFile); err != nil {
+			return nil, err
+		}
+		cluster.Authenticator = passwordFileAuthenticator{authConf.Username, authConf.PasswordFile}
+	} else if authConf.Username != "" {
 		cluster.Authenticator = gocql.PasswordAuthenticator{
 			Username: authConf.Username,
 			Password: authConf.Password,
@@ -92,38 +121,271 @@ func createSession(config *Config) (*gocql.Session, error) {
 	return cluster.CreateSession()
 }
 
-// NewCassandraStore constructs new instances of CassandraStore.
-func NewCassandraStore(config *Config) (*CassandraStore, error) {
-	session, err := createSession(config)
-	if err == nil {
-		return &CassandraStore{session: session, Keyspace: config.Cassandra.Keyspace, Table: config.Cassandra.Table}, nil
+// createMigrationSession returns a session to the Cassandra cluster values are being migrated from, or nil if
+// migration is not enabled, or is from tables of the same cluster.
+func createMigrationSession(config *Config) (*gocql.Session, error) {
+	if !config.Migration.Enabled || len(config.Migration.Cassandra.Hosts) == 0 {
+		return nil, nil
+	}
+
+	old := *config
+	old.Cassandra = config.Migration.Cassandra
+
+	return createSession(&old)
+}
+
+// passwordFileAuthenticator is a gocql.Authenticator that reads the password from a file each time a connection
+// authenticates, so that a rotated password is used by new connections without a restart.
+type passwordFileAuthenticator struct {
+	username string
+	filename string
+}
+
+// Challenge reads the password file, and responds to the server's challenge as a gocql.PasswordAuthenticator would.
+func (a passwordFileAuthenticator) Challenge(req []byte) ([]byte, gocql.Authenticator, error) {
+	password, err := readSecretFile(a.filename)
+	if err != nil {
+		return nil, nil, err
 	}
-	return nil, err
+	return gocql.PasswordAuthenticator{Username: a.username, Password: password}.Challenge(req)
+}
+
+// Success is called upon successful authentication.
+func (a passwordFileAuthenticator) Success(data []byte) error {
+	return nil
+}
+
+// pingCassandra returns a function that verifies a session has connected hosts, and can execute a (lightweight)
+// query before the deadline of the context.
+func pingCassandra(session *gocql.Session) func(context.Context) error {
+	return func(ctx context.Context) error {
+		if session.Closed() {
+			return errors.New("Cassandra session is closed")
+		}
+
+		var release string
+		err := session.Query(`SELECT release_version FROM system.local`).WithContext(ctx).Consistency(gocql.One).Scan(&release)
+		switch {
+		case err == gocql.ErrNoConnections:
+			return errors.New("no connected Cassandra hosts")
+		case err != nil:
+			return fmt.Errorf("Cassandra query failed: %s", err)
+		}
+
+		return nil
+	}
+}
+
+// verifySchema inspects the cluster's schema metadata, and returns an error if the keyspace or table do not exist,
+// or if the table does not have the expected layout (a text `key` as primary key, a blob `value`, and if checksums
+// are enabled, a blob `checksum`).
+func verifySchema(session *gocql.Session, keyspace, table string, checksums bool) error {
+	meta, err := session.KeyspaceMetadata(keyspace)
+	if err != nil {
+		return fmt.Errorf("unable to read schema of keyspace %q: %s", keyspace, err)
+	}
+
+	tableMeta, ok := meta.Tables[table]
+	if !ok {
+		return fmt.Errorf("table %q.%q does not exist", keyspace, table)
+	}
+
+	if len(tableMeta.PartitionKey) != 1 || tableMeta.PartitionKey[0].Name != "key" || len(tableMeta.ClusteringColumns) != 0 {
+		return fmt.Errorf("table %q.%q must have `key` as its (sole) primary key", keyspace, table)
+	}
+
+	type column struct {
+		name  string
+		types []gocql.Type
+	}
+
+	expected := []column{
+		{"key", []gocql.Type{gocql.TypeText, gocql.TypeVarchar}},
+		{"value", []gocql.Type{gocql.TypeBlob}},
+	}
+
+	if checksums {
+		expected = append(expected, column{"checksum", []gocql.Type{gocql.TypeBlob}})
+	}
+
+	for _, col := range expected {
+		column, ok := tableMeta.Columns[col.name]
+		if !ok {
+			return fmt.Errorf("table %q.%q is missing column `%s`", keyspace, table, col.name)
+		}
+		if !hasType(column.Type, col.types) {
+			names := make([]string, len(col.types))
+			for i, t := range col.types {
+				names[i] = t.String()
+			}
+			return fmt.Errorf("column `%s` of table %q.%q has type %s (expected %s)", col.name, keyspace, table, column.Type, strings.Join(names, " or "))
+		}
+	}
+
+	return nil
+}
+
+// hasType returns true if the TypeInfo matches any of the supplied types.
+func hasType(info gocql.TypeInfo, types []gocql.Type) bool {
+	if info == nil {
+		return false
+	}
+	for _, t := range types {
+		if info.Type() == t {
+			return true
+		}
+	}
+	return false
+}
+
+// NewCassandraStore constructs new instances of CassandraStore for a namespace.  Sessions are safe for
+// concurrent use, and can be shared by the stores of each namespace.  An error is returned if the namespace
+// keyspace and table do not exist, or do not match the expected schema (see: verifySchema).
+func NewCassandraStore(session *gocql.Session, ns *Namespace) (*CassandraStore, error) {
+	if err := verifySchema(session, ns.Keyspace, ns.Table, ns.Checksums); err != nil {
+		return nil, err
+	}
+
+	store := &CassandraStore{session: session, Keyspace: ns.Keyspace, Table: ns.Table, Checksums: ns.Checksums}
+
+	var err error
+	if store.ReadConsistency, err = gocql.ParseConsistencyWrapper(ns.Consistency.Read); err != nil {
+		return nil, err
+	}
+	if store.WriteConsistency, err = gocql.ParseConsistencyWrapper(ns.Consistency.Write); err != nil {
+		return nil, err
+	}
+	if store.DeleteConsistency, err = gocql.ParseConsistencyWrapper(ns.Consistency.Delete); err != nil {
+		return nil, err
+	}
+
+	return store, nil
 }
 
 // Set stores a new value associated with a key. Values expire after TTL
 // seconds; Values with a TTL of 0 do not expire.
 func (s *CassandraStore) Set(key string, value []byte, ttl int) error {
+	if s.Checksums {
+		query := fmt.Sprintf(`INSERT INTO "%s"."%s" (key, value, checksum) VALUES (?,?,?) USING TTL ?`, s.Keyspace, s.Table)
+		return s.session.Query(query, key, value, checksum(value), ttl).Consistency(s.WriteConsistency).Exec()
+	}
 	query := fmt.Sprintf(`INSERT INTO "%s"."%s" (key, value) VALUES (?,?) USING TTL ?`, s.Keyspace, s.Table)
-	return s.session.Query(query, key, value, ttl).Consistency(gocql.LocalQuorum).Exec()
+	return s.session.Query(query, key, value, ttl).Consistency(s.WriteConsistency).Exec()
 }
 
-// Get retrieves a value associated with a key.
+// Get retrieves a value associated with a key.  If checksums are enabled, ErrChecksumMismatch is returned for
+// values that do not match their checksum (values written before checksums were enabled are not verified).
 func (s *CassandraStore) Get(key string) (Datum, error) {
 	var value []byte
 	var ttl int
+	if s.Checksums {
+		var sum []byte
+		query := fmt.Sprintf(`SELECT value, checksum, TTL(value) as ttl FROM "%s"."%s" WHERE key = ?`, s.Keyspace, s.Table)
+		if err := s.session.Query(query, key).Consistency(s.ReadConsistency).Scan(&value, &sum, &ttl); err != nil {
+			return Datum{value, ttl}, err
+		}
+		if len(sum) > 0 && !bytes.Equal(sum, checksum(value)) {
+			return Datum{}, ErrChecksumMismatch
+		}
+		return Datum{value, ttl}, nil
+	}
 	query := fmt.Sprintf(`SELECT value, TTL(value) as ttl FROM "%s"."%s" WHERE key = ?`, s.Keyspace, s.Table)
-	err := s.session.Query(query, key).Consistency(gocql.LocalQuorum).Scan(&value, &ttl)
+	err := s.session.Query(query, key).Consistency(s.ReadConsistency).Scan(&value, &ttl)
 	return Datum{value, ttl}, err
 }
 
+// Touch resets the TTL of the value associated with a key, without altering the value.  Cassandra TTLs are
+// a property of the written cell, so this is a read, followed by a (conditional) write of the same value with
+// the new TTL; See touch.
+func (s *CassandraStore) Touch(key string, ttl int) error {
+	return touch(s, key, ttl)
+}
+
+// ConditionalStore is implemented by Stores that support conditional (compare-and-set) writes.
+type ConditionalStore interface {
+	Get(string) (Datum, error)
+	CompareAndSet(key string, old []byte, value []byte, ttl int) (bool, error)
+}
+
+// touch rewrites the value of a key with a new TTL, only if it is unchanged since read; A value deleted in the
+// meantime is not resurrected (gocql.ErrNotFound is returned), and one overwritten has a TTL of its own already.
+func touch(store ConditionalStore, key string, ttl int) error {
+	datum, err := store.Get(key)
+	if err != nil {
+		return err
+	}
+
+	applied, err := store.CompareAndSet(key, datum.Value, datum.Value, ttl)
+	if err != nil || applied {
+		return err
+	}
+
+	_, err = store.Get(key)
+	return err
+}
+
 // Delete removes a value associated with a key.
 func (s *CassandraStore) Delete(key string) error {
 	query := fmt.Sprintf(`DELETE FROM "%s"."%s" WHERE key = ?`, s.Keyspace, s.Table)
-	return s.session.Query(query, key).Consistency(gocql.EachQuorum).Exec()
+	return s.session.Query(query, key).Consistency(s.DeleteConsistency).Exec()
+}
+
+// ScanRange invokes a function for every key and value in the table whose token is within (start, end].  Iteration
+// ends if the function returns an error, or if reading from Cassandra fails.
+func (s *CassandraStore) ScanRange(start, end int64, fn func(string, Datum) error) error {
+	query := fmt.Sprintf(`SELECT key, value, TTL(value) as ttl FROM "%s"."%s" WHERE token(key) > ? AND token(key) <= ?`, s.Keyspace, s.Table)
+	iter := s.session.Query(query, start, end).Consistency(s.ReadConsistency).PageSize(1000).Iter()
+
+	var key string
+	var value []byte
+	var ttl int
+
+	for iter.Scan(&key, &value, &ttl) {
+		if err := fn(key, Datum{value, ttl}); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+
+	return iter.Close()
+}
+
+// SetIfNotExists stores a value associated with a key, only if there is none (using a lightweight transaction).
+// Returns true if the value was stored.
+func (s *CassandraStore) SetIfNotExists(key string, value []byte, ttl int) (bool, error) {
+	// The current row is returned when the transaction is not applied.
+	current := make(map[string]interface{})
+	if s.Checksums {
+		query := fmt.Sprintf(`INSERT INTO "%s"."%s" (key, value, checksum) VALUES (?,?,?) IF NOT EXISTS USING TTL ?`, s.Keyspace, s.Table)
+		return s.session.Query(query, key, value, checksum(value), ttl).Consistency(s.WriteConsistency).MapScanCAS(current)
+	}
+	query := fmt.Sprintf(`INSERT INTO "%s"."%s" (key, value) VALUES (?,?) IF NOT EXISTS USING TTL ?`, s.Keyspace, s.Table)
+	return s.session.Query(query, key, value, ttl).Consistency(s.WriteConsistency).MapScanCAS(current)
+}
+
+// DeleteIf removes the value associated with a key, only if it is value (using a lightweight transaction).
+// Returns true if the value was removed.
+func (s *CassandraStore) DeleteIf(key string, value []byte) (bool, error) {
+	var current []byte
+	query := fmt.Sprintf(`DELETE FROM "%s"."%s" WHERE key = ? IF value = ?`, s.Keyspace, s.Table)
+	return s.session.Query(query, key, value).Consistency(s.DeleteConsistency).ScanCAS(&current)
+}
+
+// CompareAndSet stores a new value associated with a key, only if the current value is old (using a lightweight
+// transaction).  Returns true if the value was stored.
+func (s *CassandraStore) CompareAndSet(key string, old []byte, value []byte, ttl int) (bool, error) {
+	// The current value is returned when the transaction is not applied.
+	var current []byte
+	if s.Checksums {
+		query := fmt.Sprintf(`UPDATE "%s"."%s" USING TTL ? SET value = ?, checksum = ? WHERE key = ? IF value = ?`, s.Keyspace, s.Table)
+		return s.session.Query(query, ttl, value, checksum(value), key, old).Consistency(s.WriteConsistency).ScanCAS(&current)
+	}
+	query := fmt.Sprintf(`UPDATE "%s"."%s" USING TTL ? SET value = ? WHERE key = ? IF value = ?`, s.Keyspace, s.Table)
+	return s.session.Query(query, ttl, value, key, old).Consistency(s.WriteConsistency).ScanCAS(&current)
 }
 
-// Close terminates the underlying session to Cassandra (disconnects).
+// Close terminates the underlying session to Cassandra (disconnects).  Note: The session may be shared with
+// the stores of other namespaces.
 func (s *CassandraStore) Close() {
 	s.session.Close()
 }
@@ -21,6 +21,7 @@
 package main
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -36,11 +37,17 @@ func setup(t *testing.T) (*CassandraStore, error) {
 	}
 
 	// Connect
-	store, err := NewCassandraStore(config)
+	session, err := createSession(config)
 	if err != nil {
 		return nil, err
 	}
 
+	store, err := NewCassandraStore(session, &config.Namespaces[0])
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
 	return store, nil
 }
 
@@ -117,3 +124,115 @@ func TestTTL(t *testing.T) {
 		t.Errorf("Expected value to have expired but result (%v) returned", res)
 	}
 }
+
+func TestCassandraTouchDeleted(t *testing.T) {
+	store, err := setup(t)
+	if err != nil {
+		t.Errorf("Test setup failure: %s", err)
+		return
+	}
+
+	key := RandString(8)
+
+	if err := store.Set(key, []byte(RandString(32)), defaultTTL); err != nil {
+		t.Fatalf("Error storing value (%s)", err)
+	}
+	if err := store.Delete(key); err != nil {
+		t.Fatalf("Error deleting value (%s)", err)
+	}
+
+	if err := store.Touch(key, defaultTTL); err != gocql.ErrNotFound {
+		t.Errorf("Expected gocql.ErrNotFound touching a deleted value, got: %v", err)
+	}
+	if res, err := store.Get(key); err != gocql.ErrNotFound {
+		t.Errorf("Expected deleted value to stay deleted, but result (%v) returned", res)
+	}
+}
+
+func TestScanRange(t *testing.T) {
+	store, err := setup(t)
+	if err != nil {
+		t.Fatalf("Test setup failure: %s", err)
+	}
+
+	keys := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		key := RandString(8)
+		if err := store.Set(key, []byte(RandString(32)), defaultTTL); err != nil {
+			t.Fatalf("Error storing value (%s)", err)
+		}
+		keys[key] = true
+	}
+
+	// Every key is found in (exactly) one of the ranges.
+	found := make(map[string]int)
+	for _, r := range tokenRanges(4) {
+		err := store.ScanRange(r[0], r[1], func(key string, datum Datum) error {
+			found[key]++
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Error scanning token range (%s)", err)
+		}
+	}
+
+	for key := range keys {
+		AssertEquals(t, 1, found[key], "Incorrect number of times key scanned")
+	}
+}
+
+func TestSchemaVerification(t *testing.T) {
+	config, err := ReadConfig(*confFile)
+	if err != nil {
+		t.Fatalf("Test setup failure: %s", err)
+	}
+
+	session, err := createSession(config)
+	if err != nil {
+		t.Fatalf("Test setup failure: %s", err)
+	}
+	defer session.Close()
+
+	t.Run("Missing table", func(t *testing.T) {
+		ns := config.Namespaces[0]
+		ns.Table = RandString(8)
+		if _, err := NewCassandraStore(session, &ns); err == nil {
+			t.Errorf("Nonexistent table %q expected to fail verification!", ns.Table)
+		}
+	})
+
+	t.Run("Missing keyspace", func(t *testing.T) {
+		ns := config.Namespaces[0]
+		ns.Keyspace = RandString(8)
+		if _, err := NewCassandraStore(session, &ns); err == nil {
+			t.Errorf("Nonexistent keyspace %q expected to fail verification!", ns.Keyspace)
+		}
+	})
+}
+
+func TestPingCassandra(t *testing.T) {
+	config, err := ReadConfig(*confFile)
+	if err != nil {
+		t.Fatalf("Test setup failure: %s", err)
+	}
+
+	session, err := createSession(config)
+	if err != nil {
+		t.Fatalf("Test setup failure: %s", err)
+	}
+
+	ping := pingCassandra(session)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := ping(ctx); err != nil {
+		t.Errorf("Ping of connected session failed: %s", err)
+	}
+
+	session.Close()
+
+	if err := ping(ctx); err == nil {
+		t.Errorf("Ping of closed session expected to fail!")
+	}
+}
@@ -0,0 +1,287 @@
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Operations, for the purpose of client certificate allow-lists.
+const (
+	opRead   = "read"
+	opWrite  = "write"
+	opDelete = "delete"
+)
+
+// TLS protocol versions, by configuration name.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Elliptic curves (for key exchange), by configuration name.
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+}
+
+// cipherSuiteID returns the ID of a (secure) cipher suite by its IANA name, i.e. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256.
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// NewAdminTLSConfig returns the TLS configuration of the admin listener; The protocol versions, cipher suites, and
+// curves are those of the server, but client certificates are not verified.
+func NewAdminTLSConfig(config *Config) *tls.Config {
+	tlsConfig := &tls.Config{
+		MinVersion: tlsVersions[config.TLS.MinVersion],
+		MaxVersion: tlsVersions[config.TLS.MaxVersion],
+	}
+
+	for _, name := range config.TLS.CipherSuites {
+		id, _ := cipherSuiteID(name)
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+
+	for _, name := range config.TLS.Curves {
+		tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, tlsCurves[name])
+	}
+
+	return tlsConfig
+}
+
+// NewTLSConfig returns the server TLS configuration.  When a client CA is configured, client certificates are
+// verified against it (and required, unless client_auth is "optional").
+func NewTLSConfig(config *Config) (*tls.Config, error) {
+	tlsConfig := NewAdminTLSConfig(config)
+
+	if config.TLS.ClientCAPath == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := ioutil.ReadFile(config.TLS.ClientCAPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", config.TLS.ClientCAPath)
+	}
+
+	tlsConfig.ClientCAs = pool
+
+	if config.TLS.ClientAuth == "optional" {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	} else {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// CertificateReloader serves a certificate (and key) from files that may be replaced while running, i.e. when
+// certificates are rotated.  The files are (re)loaded with Reload, or by Watch when changed.
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+	logger   *Logger
+	expiry   prometheus.Gauge
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+// NewCertificateReloader returns a CertificateReloader for the certificate and key files, having loaded them.  The
+// expiry of each certificate loaded is set on the gauge (as a Unix timestamp).
+func NewCertificateReloader(certFile, keyFile string, logger *Logger, expiry prometheus.Gauge) (*CertificateReloader, error) {
+	r := &CertificateReloader{certFile: certFile, keyFile: keyFile, logger: logger, expiry: expiry}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate and key files; On error, the certificate previously loaded remains in use.
+func (r *CertificateReloader) Reload() error {
+	modTimes, err := r.stat()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTimes = modTimes
+	r.mu.Unlock()
+
+	r.expiry.Set(float64(leaf.NotAfter.Unix()))
+	r.logger.Info("Loaded TLS certificate %s (subject: %s, expires: %s)", r.certFile, leaf.Subject, leaf.NotAfter.Format(time.RFC3339))
+
+	return nil
+}
+
+// stat returns the modification times of the certificate and key files.
+func (r *CertificateReloader) stat() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, filename := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// changed returns true if either of the certificate or key files have been modified since last loaded.
+func (r *CertificateReloader) changed() bool {
+	modTimes, err := r.stat()
+	if err != nil {
+		return false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return modTimes != r.modTimes
+}
+
+// Watch polls the certificate and key files at interval (until stop is closed), reloading them when changed.
+func (r *CertificateReloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			if err := r.Reload(); err != nil {
+				r.logger.Error("Error reloading TLS certificate (retaining the current one): %s", err)
+			}
+		}
+	}
+}
+
+// GetCertificate returns the current certificate; It satisfies tls.Config.GetCertificate.
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// certificateIdentities returns the subject common name, and DNS subject alternative names of the verified
+// client certificate of a request (if any).
+func certificateIdentities(r *http.Request) []string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+
+	var identities []string
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	return append(identities, cert.DNSNames...)
+}
+
+// operation returns the operation (read, write, or delete) corresponding to the method of a request.
+func operation(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return opRead
+	case http.MethodDelete:
+		return opDelete
+	default:
+		return opWrite
+	}
+}
+
+// ClientCertificateMiddleware returns HTTP middleware that restricts each operation to clients presenting a
+// verified certificate whose subject CN, or DNS SANs match an entry in the corresponding allow-list.  Operations
+// with an empty allow-list are unrestricted.  The subject CN of a verified certificate (or its first DNS SAN, if
+// the CN is empty) is added to the request context as the client identity (i.e. cert:mw1001.eqiad.wmnet).  Requests without a verified certificate
+// are rejected with a NotAuthorized problem, and those with a certificate not in the allow-list with Forbidden.
+func ClientCertificateMiddleware(allowed map[string][]string, logger *Logger, next http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identities := certificateIdentities(r)
+
+		if list := allowed[operation(r)]; len(list) > 0 && !intersects(list, identities) {
+			if len(identities) == 0 {
+				HTTPError(w, NotAuthorized(r.URL.Path))
+			} else {
+				HTTPError(w, Forbidden(r.URL.Path))
+			}
+			logger.RequestID(getRequestID(r)).Log(LogWarning, "Client certificate (%v) not allowed to %s", identities, operation(r))
+			return
+		}
+
+		if len(identities) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), identityKey, qualifyIdentity(sourceCert, identities[0])))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// intersects returns true if any of the values in a are also in b.
+func intersects(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
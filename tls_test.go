@@ -0,0 +1,271 @@
+//go:build unit
+// +build unit
+
+/*
+ * Copyright 2019 Clara Andrew-Wani <candrew@wikimedia.org>, Eric Evans <eevans@wikimedia.org>,
+ * and Wikimedia Foundation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// generateCertificate writes a self-signed certificate (and its key) to temporary files, returning their names.
+func generateCertificate(t *testing.T, cn string, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              []string{cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Unable to create certificate: %s", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Unable to marshal key: %s", err)
+	}
+
+	certFile := writeTempFile(t, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	keyFile := writeTempFile(t, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})))
+
+	return certFile, keyFile
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	caFile, keyFile := generateCertificate(t, "ca.example.org", time.Now().Add(time.Hour))
+	defer os.Remove(caFile)
+	defer os.Remove(keyFile)
+
+	testCases := []struct {
+		clientAuth string
+		expected   tls.ClientAuthType
+	}{
+		{"", tls.RequireAndVerifyClientCert},
+		{"required", tls.RequireAndVerifyClientCert},
+		{"optional", tls.VerifyClientCertIfGiven},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("client_auth=%q", tc.clientAuth), func(t *testing.T) {
+			config, err := NewConfig([]byte(fmt.Sprintf("tls:\n  cert: %s\n  key: %s\n  client_ca: %s\n  client_auth: %q", caFile, keyFile, caFile, tc.clientAuth)))
+			if err != nil {
+				t.Fatalf("Unable to create Config instance: %s", err)
+			}
+
+			tlsConfig, err := NewTLSConfig(config)
+			if err != nil {
+				t.Fatalf("Unable to create TLS config: %s", err)
+			}
+
+			AssertEquals(t, tc.expected, tlsConfig.ClientAuth, "Incorrect client auth type")
+			if tlsConfig.ClientCAs == nil {
+				t.Errorf("Client CA pool not configured")
+			}
+		})
+	}
+
+	t.Run("Invalid CA", func(t *testing.T) {
+		config, err := NewConfig([]byte(fmt.Sprintf("tls:\n  cert: %s\n  key: %s\n  client_ca: %s", caFile, keyFile, keyFile)))
+		if err != nil {
+			t.Fatalf("Unable to create Config instance: %s", err)
+		}
+		if _, err := NewTLSConfig(config); err == nil {
+			t.Errorf("Client CA without certificates expected to fail!")
+		}
+	})
+}
+
+func TestTLSParameters(t *testing.T) {
+	data := []byte(`
+tls:
+  cert: /path/to/cert
+  key: /path/to/key
+  min_version: "1.2"
+  max_version: "1.3"
+  cipher_suites: [TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256]
+  curves: [X25519, P-384]
+`)
+	config, err := NewConfig(data)
+	if err != nil {
+		t.Fatalf("Unable to create Config instance: %s", err)
+	}
+
+	tlsConfig, err := NewTLSConfig(config)
+	if err != nil {
+		t.Fatalf("Unable to create TLS config: %s", err)
+	}
+
+	AssertEquals(t, uint16(tls.VersionTLS12), tlsConfig.MinVersion, "Incorrect min version")
+	AssertEquals(t, uint16(tls.VersionTLS13), tlsConfig.MaxVersion, "Incorrect max version")
+	AssertEquals(t, 2, len(tlsConfig.CipherSuites), "Incorrect number of cipher suites")
+	AssertEquals(t, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tlsConfig.CipherSuites[0], "Incorrect cipher suite")
+	AssertEquals(t, tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256, tlsConfig.CipherSuites[1], "Incorrect cipher suite")
+	AssertEquals(t, 2, len(tlsConfig.CurvePreferences), "Incorrect number of curves")
+	AssertEquals(t, tls.X25519, tlsConfig.CurvePreferences[0], "Incorrect curve")
+	AssertEquals(t, tls.CurveP384, tlsConfig.CurvePreferences[1], "Incorrect curve")
+	AssertEquals(t, true, config.TLS.HTTP2, "HTTP/2 not enabled by default")
+
+	// The admin listener is configured alike
+	adminTLSConfig := NewAdminTLSConfig(config)
+
+	AssertEquals(t, uint16(tls.VersionTLS12), adminTLSConfig.MinVersion, "Incorrect admin min version")
+	AssertEquals(t, uint16(tls.VersionTLS13), adminTLSConfig.MaxVersion, "Incorrect admin max version")
+	AssertEquals(t, 2, len(adminTLSConfig.CipherSuites), "Incorrect number of admin cipher suites")
+	AssertEquals(t, 2, len(adminTLSConfig.CurvePreferences), "Incorrect number of admin curves")
+	AssertEquals(t, tls.NoClientCert, adminTLSConfig.ClientAuth, "Admin client certificates verified")
+}
+
+func TestClientCertificateMiddleware(t *testing.T) {
+	logger, err := NewLogger(ioutil.Discard, "kask", "info")
+	if err != nil {
+		t.Fatalf("Unable to create Logger instance: %s", err)
+	}
+
+	allowed := map[string][]string{
+		opRead:  {"mw1001.eqiad.wmnet", "icinga1001.wikimedia.org"},
+		opWrite: {"mw1001.eqiad.wmnet"},
+	}
+
+	var identity string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity = getIdentity(r)
+	})
+	middleware := ClientCertificateMiddleware(allowed, logger, handler)
+
+	testCases := []struct {
+		method     string
+		cn         string
+		statusCode int
+	}{
+		{"GET", "mw1001.eqiad.wmnet", 200},
+		{"POST", "mw1001.eqiad.wmnet", 200},
+		{"GET", "icinga1001.wikimedia.org", 200},
+		{"POST", "icinga1001.wikimedia.org", 403},
+		{"DELETE", "icinga1001.wikimedia.org", 200},
+		{"GET", "evil.example.org", 403},
+		{"GET", "", 401},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s %s", tc.method, tc.cn), func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, path.Join(prefixURI, "cat"), nil)
+			if tc.cn != "" {
+				cert := &x509.Certificate{Subject: pkix.Name{CommonName: tc.cn}}
+				req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+			}
+			rr := httptest.NewRecorder()
+
+			identity = ""
+			middleware.ServeHTTP(rr, req)
+
+			AssertEquals(t, tc.statusCode, rr.Code, "Incorrect status code")
+			if tc.statusCode == 200 {
+				AssertEquals(t, "cert:"+tc.cn, identity, "Incorrect identity")
+			}
+		})
+	}
+}
+
+func TestCertificateReloader(t *testing.T) {
+	logger, err := NewLogger(ioutil.Discard, "kask", "info")
+	if err != nil {
+		t.Fatalf("Unable to create Logger instance: %s", err)
+	}
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	certFile, keyFile := generateCertificate(t, "kask1.example.org", expires)
+	defer os.Remove(certFile)
+	defer os.Remove(keyFile)
+
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "expiry"})
+
+	reloader, err := NewCertificateReloader(certFile, keyFile, logger, gauge)
+	if err != nil {
+		t.Fatalf("Unable to create CertificateReloader: %s", err)
+	}
+
+	cert, _ := reloader.GetCertificate(nil)
+	AssertEquals(t, "kask1.example.org", cert.Leaf.Subject.CommonName, "Incorrect certificate")
+	AssertEquals(t, float64(expires.Unix()), testutil.ToFloat64(gauge), "Incorrect expiry")
+	AssertEquals(t, false, reloader.changed(), "Unmodified certificate reported changed")
+
+	// Rotate the certificate (and key)
+	newExpires := expires.Add(time.Hour)
+	newCertFile, newKeyFile := generateCertificate(t, "kask2.example.org", newExpires)
+	defer os.Remove(newCertFile)
+	defer os.Remove(newKeyFile)
+
+	later := time.Now().Add(time.Minute)
+	for _, names := range [][2]string{{newCertFile, certFile}, {newKeyFile, keyFile}} {
+		if err := os.Rename(names[0], names[1]); err != nil {
+			t.Fatalf("Unable to replace file: %s", err)
+		}
+		os.Chtimes(names[1], later, later)
+	}
+
+	AssertEquals(t, true, reloader.changed(), "Modified certificate not reported changed")
+
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("Unable to reload certificate: %s", err)
+	}
+
+	cert, _ = reloader.GetCertificate(nil)
+	AssertEquals(t, "kask2.example.org", cert.Leaf.Subject.CommonName, "Incorrect certificate")
+	AssertEquals(t, float64(newExpires.Unix()), testutil.ToFloat64(gauge), "Incorrect expiry")
+
+	t.Run("Invalid", func(t *testing.T) {
+		if err := ioutil.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+			t.Fatalf("Unable to write file: %s", err)
+		}
+		if err := reloader.Reload(); err == nil {
+			t.Errorf("Reload of invalid key expected to fail!")
+		}
+
+		cert, _ = reloader.GetCertificate(nil)
+		AssertEquals(t, "kask2.example.org", cert.Leaf.Subject.CommonName, "Certificate not retained")
+	})
+}